@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeFileAtomic writes data to a temporary file next to file, syncs it
+// and renames it into place, so readers never see a half-written file.
+// Before the rename, the current version is kept as numbered backup
+// file.1 (newest) up to file.<backups> (oldest). An existing file keeps
+// its mode, owner and group; perm is only used for a new file.
+func writeFileAtomic(file string, data []byte, perm os.FileMode, backups int) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(file); err == nil {
+		keepOwner(tmp.Name(), info)
+		perm = info.Mode().Perm()
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	if err = rotateBackups(file, backups); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(file))
+}
+
+func backupName(file string, n int) string {
+	return file + "." + strconv.Itoa(n)
+}
+
+// rotateBackups shifts file.1 .. file.<n-1> one place up, dropping the
+// oldest, and stores the current contents of file as file.1.
+func rotateBackups(file string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := os.Remove(backupName(file, n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := n - 1; i >= 1; i-- {
+		err := os.Rename(backupName(file, i), backupName(file, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// A hard link is cheap and keeps the old inode after the rename;
+	// fall back to a copy on filesystems without link support.
+	if err := os.Link(file, backupName(file, 1)); err == nil {
+		return nil
+	}
+	return copyFile(file, backupName(file, 1))
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Not every platform supports syncing a directory; the rename has
+	// happened either way.
+	d.Sync()
+	return nil
+}
+
+func restoreBackup(file string, backend string, n int) {
+	s, err := openStorage(file, backend, false)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	fs, ok := s.(*fileStorage)
+	if !ok {
+		print("Backups are only kept for single file backends\n")
+		return
+	}
+
+	dat, err := ioutil.ReadFile(backupName(file, n))
+	if err != nil {
+		print("No backup " + strconv.Itoa(n) + " found for '" + file + "'\n")
+		return
+	}
+
+	conf, err := decodeConfig(fs.codec, dat)
+	if err != nil {
+		print("Backup " + strconv.Itoa(n) + " is not a valid task file: " + err.Error() + "\n")
+		return
+	}
+
+	// The restore is journaled like any other change, so rebuild and
+	// undo know about it. The version being replaced becomes backup 1,
+	// so a restore can itself be undone by restoring backup 1.
+	if err = newJournalStorage(fs, file, "restore-backup").Save(&conf); err != nil {
+		panic(err)
+	}
+	print("Restored '" + file + "' from backup " + strconv.Itoa(n) + "\n")
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// keepOwner gives path the owner and group of the file it replaces, or
+// at least the group when we may not change the owner.
+func keepOwner(path string, info os.FileInfo) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if os.Chown(path, int(st.Uid), int(st.Gid)) != nil {
+		os.Chown(path, -1, int(st.Gid))
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// keepOwner has nothing to do on Windows, where the new file inherits
+// the permissions of the directory.
+func keepOwner(path string, info os.FileInfo) {
+}
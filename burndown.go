@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RemainingWork is the work left on the task: nothing once it is closed,
+// otherwise the remaining work if set, or else the estimate.
+func (t *Task) RemainingWork() float64 {
+	switch {
+	case t.IsDone():
+		return 0
+	case t.Remaining != nil:
+		return *t.Remaining
+	}
+	return t.Estimate
+}
+
+// workSum adds up estimates and remaining work of a group of tasks.
+type workSum struct {
+	Estimate  float64 `json:"estimate"`
+	Remaining float64 `json:"remaining"`
+}
+
+func (w workSum) add(task Task) workSum {
+	w.Estimate += task.Estimate
+	w.Remaining += task.RemainingWork()
+	return w
+}
+
+func parseAmount(value string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, fmt.Errorf("'%s' is not an amount of work; use a number like 3 or 1.5", value)
+	}
+	return f, nil
+}
+
+func setTaskEstimate(s Storage, name string, value string) {
+	estimate, err := parseAmount(value)
+	if err != nil {
+		print(err.Error() + "\n")
+		return
+	}
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		task.Estimate = estimate
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+// setTaskRemaining sets the work left; "none" goes back to the estimate.
+func setTaskRemaining(s Storage, name string, value string) {
+	var remaining *float64
+	if value != "none" {
+		r, err := parseAmount(value)
+		if err != nil {
+			print(err.Error() + "\n")
+			return
+		}
+		remaining = &r
+	}
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		task.Remaining = remaining
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+type BurndownPoint struct {
+	Date      string  `json:"date"`
+	Remaining float64 `json:"remaining"`
+	Open      int     `json:"open"`
+}
+
+// burndown replays the journal and takes the remaining work of the tasks
+// matching the filters at the end of every day from since up to today.
+func burndown(events []Event, since time.Time, now time.Time) []BurndownPoint {
+	points := []BurndownPoint{}
+	tasks := map[string]Task{}
+	i := 0
+	for day := startOfDay(since); !day.After(now); day = day.AddDate(0, 0, 1) {
+		end := day.AddDate(0, 0, 1)
+		for ; i < len(events) && parseTime(events[i].At).Before(end); i++ {
+			if e := events[i]; e.After == nil {
+				delete(tasks, e.Task)
+			} else {
+				tasks[e.Task] = *e.After
+			}
+		}
+		p := BurndownPoint{Date: formatDate(day)}
+		for _, task := range tasks {
+			if !matchesFilters(task) {
+				continue
+			}
+			p.Remaining += task.RemainingWork()
+			if !task.IsDone() {
+				p.Open++
+			}
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+const burndownWidth = 50
+
+func showBurndown(file string, sinceValue string) {
+	now := time.Now()
+	since := startOfDay(now).AddDate(0, 0, -13)
+	if sinceValue != "" {
+		t, err := parseSheetTime(sinceValue, now, false)
+		if err != nil {
+			print(err.Error() + "\n")
+			return
+		}
+		since = t
+	}
+	j := &Journal{file: journalFile(file)}
+	if !j.exists() {
+		print("No journal '" + j.file + "' found\n")
+		return
+	}
+	events, err := j.Events()
+	if err != nil {
+		panic(err)
+	}
+	points := burndown(events, since, now)
+
+	switch *exportFormat {
+	case "table":
+		max := 0.0
+		for _, p := range points {
+			max = math.Max(max, p.Remaining)
+		}
+		for _, p := range points {
+			bar := 0
+			if max > 0 {
+				bar = int(math.Round(p.Remaining / max * burndownWidth))
+			}
+			fmt.Printf("%s |%-*s %s (%d open)\n", p.Date, burndownWidth, strings.Repeat("#", bar), formatAmount(p.Remaining), p.Open)
+		}
+	case "json":
+		res, _ := json.Marshal(points)
+		fmt.Println(string(res))
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// commentIDLength is the length of new comment IDs; it only grows when
+// two comments of a task would get the same ID.
+const commentIDLength = 7
+
+// commentID derives the ID of a comment from who wrote what when, so
+// the same comment gets the same ID wherever it is assigned, such as in
+// two clones of the task file that are migrated separately.
+func commentID(by string, at string, text string, taken func(id string) bool) string {
+	sum := sha1.Sum([]byte(at + "\x00" + by + "\x00" + text))
+	hash := hex.EncodeToString(sum[:])
+	for n := commentIDLength; n <= len(hash); n++ {
+		if !taken(hash[:n]) {
+			return hash[:n]
+		}
+	}
+	for n := 2; ; n++ {
+		if id := hash + "-" + strconv.Itoa(n); !taken(id) {
+			return id
+		}
+	}
+}
+
+// addComment adds a comment to the task, giving it an ID.
+func (t *Task) addComment(c TaskComment) TaskComment {
+	c.ID = commentID(c.By, c.At, c.Comment, func(id string) bool {
+		return t.commentIndex(id) >= 0
+	})
+	t.Comments = append(t.Comments, c)
+	return c
+}
+
+func (t *Task) commentIndex(id string) int {
+	for i, c := range t.Comments {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// findComment looks up a comment by its ID or an unambiguous start of
+// it.
+func (t *Task) findComment(id string) (int, error) {
+	if i := t.commentIndex(id); i >= 0 {
+		return i, nil
+	}
+	found := -1
+	for i, c := range t.Comments {
+		if id != "" && strings.HasPrefix(c.ID, id) {
+			if found >= 0 {
+				return -1, fmt.Errorf("comment ID '%s' is ambiguous", id)
+			}
+			found = i
+		}
+	}
+	if found < 0 {
+		return -1, fmt.Errorf("no comment '%s' found", id)
+	}
+	return found, nil
+}
+
+// CommentCount counts the comments that were not deleted.
+func (t *Task) CommentCount() int {
+	n := 0
+	for _, c := range t.Comments {
+		if !c.Deleted {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *Task) hasReplies(id string) bool {
+	for _, c := range t.Comments {
+		if c.ReplyTo == id {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneComments drops deleted comments that no longer have replies to
+// keep in place.
+func (t *Task) pruneComments() {
+	for pruned := true; pruned; {
+		pruned = false
+		kept := []TaskComment{}
+		for _, c := range t.Comments {
+			if c.Deleted && !t.hasReplies(c.ID) {
+				pruned = true
+				continue
+			}
+			kept = append(kept, c)
+		}
+		t.Comments = kept
+	}
+	if len(t.Comments) == 0 {
+		t.Comments = nil
+	}
+}
+
+// scissors separates a comment written in the editor from the task shown
+// below it, which is left out. Lines starting with '#' above it are kept,
+// as they are Markdown headings.
+const scissors = "# ------------------------ >8 ------------------------"
+
+// stdinArg moves the "-" of "comment <name> -", for standard input,
+// behind a "--": kingpin would take it for a flag. A "-" anywhere else
+// is left alone, as it may be part of a title or value.
+func stdinArg(args []string) []string {
+	positional := []int{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return args
+		}
+		if arg != "-" && strings.HasPrefix(arg, "-") {
+			if flagTakesValue(arg) {
+				i++
+			}
+			continue
+		}
+		positional = append(positional, i)
+	}
+	if len(positional) != 3 || args[positional[0]] != "comment" || args[positional[2]] != "-" {
+		return args
+	}
+	i := positional[2]
+	rest := append(append([]string{}, args[:i]...), args[i+1:]...)
+	return append(rest, "--", "-")
+}
+
+// flagTakesValue tells whether a flag, as written on the command line,
+// is followed by its value.
+func flagTakesValue(arg string) bool {
+	model := app.Model()
+	groups := [][]*kingpin.FlagModel{model.Flags}
+	for _, cmd := range model.Commands {
+		groups = append(groups, cmd.Flags)
+	}
+	for _, flags := range groups {
+		for _, f := range flags {
+			if arg == "--"+f.Name || f.Short != 0 && arg == "-"+string(f.Short) {
+				return !f.IsBoolFlag()
+			}
+		}
+	}
+	return false
+}
+
+// readComment gets the text of a new comment: the words given, standard
+// input for "-", or what is written in $EDITOR.
+func readComment(name string, words []string, edit bool) (string, error) {
+	var text string
+	switch {
+	case edit && len(words) > 0:
+		return "", fmt.Errorf("give either a comment or --edit, not both")
+	case edit:
+		var err error
+		if text, err = editComment(name); err != nil {
+			return "", err
+		}
+	case len(words) == 1 && words[0] == "-":
+		dat, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		text = string(dat)
+	case len(words) == 0:
+		return "", fmt.Errorf("give a comment, '-' to read it from standard input, or --edit")
+	default:
+		text = strings.Join(words, " ")
+	}
+	// Leading spaces may indent code, so only blank lines are trimmed.
+	text = strings.TrimRight(strings.TrimLeft(text, "\r\n"), " \t\r\n")
+	if strings.TrimSpace(text) == "" {
+		return "", fmt.Errorf("the comment is empty; nothing was added")
+	}
+	return text, nil
+}
+
+// editComment opens $EDITOR on a template that shows the task.
+func editComment(name string) (string, error) {
+	f, err := ioutil.TempFile("", "task-comment-*.md")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(commentTemplate(name))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+		if runtime.GOOS == "windows" {
+			editor = []string{"notepad"}
+		}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("running %s: %v", editor[0], err)
+	}
+
+	dat, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(string(dat), "\n")
+	for i, line := range lines {
+		if strings.TrimRight(line, "\r") == scissors {
+			lines = lines[:i]
+			break
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// commentTemplate is what the editor starts with: room for the comment,
+// then the task and its latest comments.
+func commentTemplate(name string) string {
+	lines := []string{
+		"",
+		scissors,
+		"# Write the comment for task '" + name + "' above, in Markdown if you like.",
+		"# This line and everything below it are left out; an empty comment",
+		"# adds nothing.",
+	}
+	task, ok := peekTask(name)
+	if !ok {
+		lines = append(lines, "#", "# There is no task '"+name+"' yet.")
+		return strings.Join(lines, "\n") + "\n"
+	}
+	lines = append(lines, "#", "# "+task.Title)
+	if task.State != "" {
+		lines = append(lines, "# State: "+task.State)
+	}
+	if len(task.Assignees) > 0 {
+		lines = append(lines, "# Assignees: "+joinPeople(task.Assignees))
+	}
+	if task.Due != "" {
+		lines = append(lines, "# Due: "+task.HumanDue())
+	}
+	ordered, _ := commentThreads(task.Comments)
+	if len(ordered) > 3 {
+		ordered = ordered[len(ordered)-3:]
+	}
+	for _, c := range ordered {
+		if c.Deleted {
+			continue
+		}
+		lines = append(lines, "#", "# "+c.By+", "+c.HumanAt()+":")
+		for _, l := range strings.Split(c.Comment, "\n") {
+			lines = append(lines, strings.TrimRight("#   "+l, " \t"))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// peekTask reads a task under a shared lock, for use before a command
+// takes its own lock.
+func peekTask(name string) (Task, bool) {
+	if RLock(lockfile) != nil {
+		return Task{}, false
+	}
+	defer RUnlock(lockfile)
+	s, err := openStorage(*file, *backend, true)
+	if err != nil {
+		return Task{}, false
+	}
+	defer s.Close()
+	task, ok, err := s.GetTask(name)
+	return task, ok && err == nil
+}
+
+func addTaskComment(s Storage, name string, text string) {
+	commentObj := TaskComment{
+		Comment: text,
+		By:      parseUser("me"),
+		At:      time.Now().Format(time.RFC3339),
+	}
+	task, err := updateTask(s, name, func(task *Task) error {
+		task.addComment(commentObj)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	showTask(s, name, task)
+}
+
+// updateComment looks up a comment of a task and hands it to fn, which
+// may change it in place.
+func updateComment(s Storage, name string, id string, fn func(task *Task, i int) error) {
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		i, err := task.findComment(id)
+		if err != nil {
+			print("Task '" + name + "': " + err.Error() + "\n")
+			exitStatus = 1
+			return errUnchanged
+		}
+		return fn(task, i)
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+		showTaskComments(name, task)
+	}
+}
+
+// checkAuthor tells whether the current user wrote the comment; only
+// they can change it.
+func checkAuthor(c TaskComment) error {
+	if user := parseUser("me"); c.By != user {
+		print("Comment '" + c.ID + "' was written by " + c.By + ", not by " + user + "\n")
+		exitStatus = 1
+		return errUnchanged
+	}
+	return nil
+}
+
+func editTaskComment(s Storage, name string, id string, commentArray []string) {
+	text := strings.Join(commentArray, " ")
+	updateComment(s, name, id, func(task *Task, i int) error {
+		c := &task.Comments[i]
+		if c.Deleted {
+			print("Comment '" + c.ID + "' was deleted\n")
+			exitStatus = 1
+			return errUnchanged
+		}
+		if err := checkAuthor(*c); err != nil {
+			return err
+		}
+		if c.Comment == text {
+			return errUnchanged
+		}
+		c.Comment = text
+		c.EditedAt = time.Now().Format(time.RFC3339)
+		return nil
+	})
+}
+
+// deleteTaskComment removes a comment. A comment with replies stays as
+// a deleted placeholder to keep the thread together.
+func deleteTaskComment(s Storage, name string, id string) {
+	updateComment(s, name, id, func(task *Task, i int) error {
+		c := &task.Comments[i]
+		if c.Deleted {
+			print("Comment '" + c.ID + "' was already deleted\n")
+			return errUnchanged
+		}
+		if err := checkAuthor(*c); err != nil {
+			return err
+		}
+		c.Deleted = true
+		c.Comment = ""
+		c.EditedAt = time.Now().Format(time.RFC3339)
+		task.pruneComments()
+		return nil
+	})
+}
+
+func replyTaskComment(s Storage, name string, id string, commentArray []string) {
+	reply := TaskComment{
+		Comment: strings.Join(commentArray, " "),
+		By:      parseUser("me"),
+		At:      time.Now().Format(time.RFC3339),
+	}
+	updateComment(s, name, id, func(task *Task, i int) error {
+		reply.ReplyTo = task.Comments[i].ID
+		task.addComment(reply)
+		return nil
+	})
+}
+
+// commentThreads orders comments as threads: every comment is followed
+// by its replies, with how deep it is nested. Replies to a comment that
+// is gone start a thread of their own.
+func commentThreads(comments []TaskComment) ([]TaskComment, []int) {
+	ids := map[string]bool{}
+	for _, c := range comments {
+		ids[c.ID] = true
+	}
+	var ordered []TaskComment
+	var depths []int
+	seen := make([]bool, len(comments))
+	var walk func(i int, depth int)
+	walk = func(i int, depth int) {
+		if seen[i] {
+			return
+		}
+		seen[i] = true
+		ordered = append(ordered, comments[i])
+		depths = append(depths, depth)
+		for j, r := range comments {
+			if r.ReplyTo != "" && r.ReplyTo == comments[i].ID {
+				walk(j, depth+1)
+			}
+		}
+	}
+	for i, c := range comments {
+		if c.ReplyTo == "" || !ids[c.ReplyTo] {
+			walk(i, 0)
+		}
+	}
+	// Replies that loop back are not reachable from any thread.
+	for i := range comments {
+		walk(i, 0)
+	}
+	return ordered, depths
+}
+
+func showTaskComments(name string, task Task) {
+	if len(task.Comments) > 0 {
+		comments := tablewriter.NewWriter(os.Stdout)
+		// Comments are wrapped as Markdown, which keeps code blocks.
+		comments.SetAutoWrapText(false)
+		color := isTerminal(os.Stdout)
+		comments.SetHeader([]string{"", "", "Comments for task '" + name + "'", ""})
+		ordered, depths := commentThreads(task.Comments)
+		for i, comment := range ordered {
+			text := renderMarkdown(comment.Comment, color)
+			if comment.Deleted {
+				text = "(deleted)"
+			}
+			if depths[i] > 0 {
+				// Replies are indented as a whole, below the marker.
+				indent := strings.Repeat("  ", depths[i]-1)
+				text = indent + "└ " + strings.Replace(text, "\n", "\n"+indent+"  ", -1)
+			}
+			at := comment.HumanAt()
+			if comment.EditedAt != "" && !comment.Deleted {
+				at += " (edited " + comment.HumanEditedAt() + ")"
+			}
+			comments.Append([]string{comment.ID, comment.By, text, at})
+		}
+		comments.Render()
+	}
+}
@@ -7,30 +7,51 @@ import (
 )
 
 type TaskConfig struct {
-	Tasks map[string]Task `json:"tasks" yaml:"tasks"`
+	Version  int                    `json:"version" yaml:"version"`
+	Schema   map[string]FieldSchema `json:"schema,omitempty" yaml:"schema,omitempty"`
+	Workflow *Workflow              `json:"workflow,omitempty" yaml:"workflow,omitempty"`
+	Tasks    map[string]Task        `json:"tasks" yaml:"tasks"`
 }
 
 type Task struct {
 	Title      string            `json:"title" yaml:"title"`
 	Comments   []TaskComment     `json:"comments,omitempty" yaml:"comments,omitempty"`
-	Assignee   string            `json:"assignee,omitempty" yaml:"assignee,omitempty"`
+	Worklog    []WorkEntry       `json:"worklog,omitempty" yaml:"worklog,omitempty"`
+	Assignees  []string          `json:"assignees,omitempty" yaml:"assignees,omitempty"`
+	Watchers   []string          `json:"watchers,omitempty" yaml:"watchers,omitempty"`
 	State      string            `json:"state,omitempty" yaml:"state,omitempty"`
+	Tags       []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
 	AfterTasks []string          `json:"after,omitempty" yaml:"after,omitempty"`
+	Parent     string            `json:"parent,omitempty" yaml:"parent,omitempty"`
+	Due        string            `json:"due,omitempty" yaml:"due,omitempty"`
+	Estimate   float64           `json:"estimate,omitempty" yaml:"estimate,omitempty"`
+	Remaining  *float64          `json:"remaining,omitempty" yaml:"remaining,omitempty"`
+	Recur      string            `json:"recur,omitempty" yaml:"recur,omitempty"`
+	Previous   string            `json:"previous,omitempty" yaml:"previous,omitempty"`
 	CreatedAt  string            `json:"created_at,omitempty" yaml:"created_at,omitempty"`
 	UpdatedAt  string            `json:"updated_at,omitempty" yaml:"updated_at,omitempty"`
+	Revision   int               `json:"revision,omitempty" yaml:"revision,omitempty"`
 	Fields     map[string]string `json:"fields,omitempty" yaml:"fields,omitempty"`
 }
 
 type TaskComment struct {
-	Comment string `json:"comment" yaml:"comment"`
-	By      string `json:"by" yaml:"by"`
-	At      string `json:"at" yaml:"at"`
+	ID       string `json:"id,omitempty" yaml:"id,omitempty"`
+	ReplyTo  string `json:"reply_to,omitempty" yaml:"reply_to,omitempty"`
+	Comment  string `json:"comment" yaml:"comment"`
+	By       string `json:"by" yaml:"by"`
+	At       string `json:"at" yaml:"at"`
+	EditedAt string `json:"edited_at,omitempty" yaml:"edited_at,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty" yaml:"deleted,omitempty"`
 }
 
 func (tc *TaskComment) HumanAt() string {
 	return humanAt(tc.At)
 }
 
+func (tc *TaskComment) HumanEditedAt() string {
+	return humanAt(tc.EditedAt)
+}
+
 func (t *Task) HumanCreatedAt() string {
 	return humanAt(t.CreatedAt)
 }
@@ -39,6 +60,11 @@ func (t *Task) HumanUpdatedAt() string {
 	return humanAt(t.UpdatedAt)
 }
 
+// IsDone tells whether the task is in a closed state of the workflow.
+func (t *Task) IsDone() bool {
+	return activeWorkflow.IsClosed(t.State)
+}
+
 func (t *Task) GetField(field string) string {
 	for k, v := range t.Fields {
 		if k == field {
@@ -48,8 +74,10 @@ func (t *Task) GetField(field string) string {
 	return "(unset)"
 }
 
+// Update marks the task as changed; every change raises the revision.
 func (t *Task) Update() {
 	now := time.Now().Format(time.RFC3339)
+	t.Revision++
 	t.UpdatedAt = now
 	if t.CreatedAt == "" {
 		t.CreatedAt = now
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// ScheduleEntry is the result of the critical path method for one task.
+// Times are in the unit of the estimates, counted from now.
+type ScheduleEntry struct {
+	Name          string  `json:"name"`
+	Title         string  `json:"title"`
+	Estimate      float64 `json:"estimate"`
+	EarliestStart float64 `json:"earliest_start"`
+	EarliestEnd   float64 `json:"earliest_end"`
+	LatestStart   float64 `json:"latest_start"`
+	LatestEnd     float64 `json:"latest_end"`
+	Slack         float64 `json:"slack"`
+	Critical      bool    `json:"critical"`
+}
+
+type Schedule struct {
+	Duration     float64         `json:"duration"`
+	CriticalPath []string        `json:"critical_path"`
+	Tasks        []ScheduleEntry `json:"tasks"`
+	// Unestimated lists open tasks without an estimate or remaining
+	// work; they count as taking no time.
+	Unestimated []string `json:"unestimated,omitempty"`
+}
+
+// taskEstimate returns the work left on an open task, and whether it is
+// known at all.
+func taskEstimate(task Task) (float64, bool) {
+	return task.RemainingWork(), task.Estimate != 0 || task.Remaining != nil
+}
+
+// schedule runs the critical path method over the open tasks matching the
+// filters, e.g. those of one epic. Done tasks take no more time, so they
+// are left out altogether.
+func schedule(conf *TaskConfig) (Schedule, error) {
+	result := Schedule{Tasks: []ScheduleEntry{}}
+
+	open := map[string]Task{}
+	for name, task := range conf.Tasks {
+		if !task.IsDone() && matchesFilters(task) {
+			open[name] = task
+		}
+	}
+
+	order, err := topologicalOrder(open)
+	if err != nil {
+		return result, err
+	}
+
+	entries := map[string]*ScheduleEntry{}
+	for _, name := range order {
+		task := open[name]
+		e := &ScheduleEntry{Name: name, Title: task.Title}
+		estimate, ok := taskEstimate(task)
+		if !ok {
+			result.Unestimated = append(result.Unestimated, name)
+		}
+		e.Estimate = estimate
+		for _, after := range task.AfterTasks {
+			if prev, ok := entries[after]; ok && prev.EarliestEnd > e.EarliestStart {
+				e.EarliestStart = prev.EarliestEnd
+			}
+		}
+		e.EarliestEnd = e.EarliestStart + e.Estimate
+		if e.EarliestEnd > result.Duration {
+			result.Duration = e.EarliestEnd
+		}
+		entries[name] = e
+	}
+
+	// Backward pass: a task has to end before the earliest latest start
+	// of the tasks waiting for it.
+	waiting := map[string][]string{}
+	for _, name := range order {
+		for _, after := range open[name].AfterTasks {
+			waiting[after] = append(waiting[after], name)
+		}
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		e := entries[order[i]]
+		e.LatestEnd = result.Duration
+		for _, next := range waiting[e.Name] {
+			if entries[next].LatestStart < e.LatestEnd {
+				e.LatestEnd = entries[next].LatestStart
+			}
+		}
+		e.LatestStart = e.LatestEnd - e.Estimate
+		e.Slack = e.LatestStart - e.EarliestStart
+		e.Critical = e.Slack < 1e-9
+	}
+
+	for _, name := range order {
+		result.Tasks = append(result.Tasks, *entries[name])
+	}
+	sort.SliceStable(result.Tasks, func(i, j int) bool {
+		return result.Tasks[i].EarliestStart < result.Tasks[j].EarliestStart
+	})
+	result.CriticalPath = criticalPath(entries, waiting, order)
+	sort.Strings(result.Unestimated)
+	return result, nil
+}
+
+// criticalPath follows critical tasks from the start to the end of the
+// schedule, picking the longest task at every branch.
+func criticalPath(entries map[string]*ScheduleEntry, waiting map[string][]string, order []string) []string {
+	path := []string{}
+	var current *ScheduleEntry
+	for _, name := range order {
+		e := entries[name]
+		if e.Critical && e.EarliestStart == 0 && (current == nil || e.Estimate > current.Estimate) {
+			current = e
+		}
+	}
+	for current != nil {
+		path = append(path, current.Name)
+		var next *ScheduleEntry
+		for _, name := range waiting[current.Name] {
+			e := entries[name]
+			if e.Critical && e.EarliestStart == current.EarliestEnd && (next == nil || e.Estimate > next.Estimate) {
+				next = e
+			}
+		}
+		current = next
+	}
+	return path
+}
+
+// topologicalOrder sorts the tasks so every task comes after the tasks it
+// waits for. Dependencies on tasks outside the map are ignored.
+func topologicalOrder(tasks map[string]Task) ([]string, error) {
+	names := []string{}
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	order := []string{}
+	state := map[string]int{} // 1: visiting, 2: done
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, after := range tasks[name].AfterTasks {
+			if _, ok := tasks[after]; !ok {
+				continue
+			}
+			if err := visit(after, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+func showCriticalPath(conf *TaskConfig) {
+	result, err := schedule(conf)
+	if err != nil {
+		print(err.Error() + "\n")
+		return
+	}
+
+	switch *exportFormat {
+	case "table":
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetColWidth(100)
+		table.SetHeader([]string{"Name", "Title", "Estimate", "Earliest start", "Latest start", "Slack", "Critical"})
+		for _, e := range result.Tasks {
+			critical := ""
+			if e.Critical {
+				critical = "*"
+			}
+			table.Append([]string{e.Name, e.Title, formatAmount(e.Estimate), formatAmount(e.EarliestStart), formatAmount(e.LatestStart), formatAmount(e.Slack), critical})
+		}
+		table.Render()
+		fmt.Println("Critical path: " + strings.Join(result.CriticalPath, " -> "))
+		fmt.Println("Remaining duration: " + formatAmount(result.Duration))
+		if len(result.Unestimated) > 0 {
+			fmt.Println("Without estimate: " + strings.Join(result.Unestimated, ", "))
+		}
+	case "json":
+		res, _ := json.Marshal(result)
+		fmt.Println(string(res))
+	}
+}
+
+func formatAmount(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// taskLookup finds a task by name; dependencies are resolved through it
+// both for a whole loaded task list and for single tasks in a Storage.
+type taskLookup func(name string) (Task, bool)
+
+func mapLookup(tasks map[string]Task) taskLookup {
+	return func(name string) (Task, bool) {
+		task, ok := tasks[name]
+		return task, ok
+	}
+}
+
+func storageLookup(s Storage) taskLookup {
+	return func(name string) (Task, bool) {
+		task, ok, err := s.GetTask(name)
+		if err != nil {
+			panic(err)
+		}
+		return task, ok
+	}
+}
+
+// taskReader is implemented by storages that read several tasks at once
+// more cheaply than one by one.
+type taskReader interface {
+	GetTasks(names []string) (map[string]Task, error)
+}
+
+// getTasks returns those of the named tasks that exist in s.
+func getTasks(s Storage, names []string) (map[string]Task, error) {
+	if reader, ok := s.(taskReader); ok {
+		return reader.GetTasks(names)
+	}
+	tasks := map[string]Task{}
+	for _, name := range names {
+		task, ok, err := s.GetTask(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			tasks[name] = task
+		}
+	}
+	return tasks, nil
+}
+
+// blockers returns the tasks that have to be done before task can start.
+// Tasks that no longer exist do not block anything.
+func blockers(lookup taskLookup, task Task) []string {
+	result := []string{}
+	for _, name := range task.AfterTasks {
+		if other, ok := lookup(name); ok && !other.IsDone() {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// dependencyPath returns a chain of tasks from "from" to "to" following
+// the after-relation, or nil if there is none.
+func dependencyPath(lookup taskLookup, from string, to string) []string {
+	seen := map[string]bool{}
+	var walk func(name string) []string
+	walk = func(name string) []string {
+		if name == to {
+			return []string{name}
+		}
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		task, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+		for _, next := range task.AfterTasks {
+			if path := walk(next); path != nil {
+				return append([]string{name}, path...)
+			}
+		}
+		return nil
+	}
+	return walk(from)
+}
+
+func dependTask(s Storage, name string, others []string) {
+	refused := false
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		lookup := storageLookup(tx)
+		for _, other := range others {
+			if _, ok := lookup(other); !ok {
+				print("No task '" + other + "' found\n")
+				refused = true
+				return errUnchanged
+			}
+			if other == name {
+				print("Task '" + name + "' cannot depend on itself\n")
+				refused = true
+				return errUnchanged
+			}
+			// Adding name -> other closes a cycle if other already
+			// (indirectly) comes after name.
+			if path := dependencyPath(lookup, other, name); path != nil {
+				print("Task '" + name + "' cannot depend on '" + other + "': " + strings.Join(append([]string{name}, path...), " -> ") + " would be a cycle\n")
+				refused = true
+				return errUnchanged
+			}
+		}
+		for _, other := range others {
+			if !contains(task.AfterTasks, other) {
+				task.AfterTasks = append(task.AfterTasks, other)
+			}
+		}
+		sort.Strings(task.AfterTasks)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if refused {
+		exitStatus = 1
+		return
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+func undependTask(s Storage, name string, others []string) {
+	task, err := updateTask(s, name, func(task *Task) error {
+		after := []string{}
+		for _, other := range task.AfterTasks {
+			if !contains(others, other) {
+				after = append(after, other)
+			}
+		}
+		if len(after) == len(task.AfterTasks) {
+			print("Task '" + name + "' does not depend on any of these tasks\n")
+			return errUnchanged
+		}
+		if len(after) == 0 {
+			after = nil
+		}
+		task.AfterTasks = after
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	showTask(s, name, task)
+}
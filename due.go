@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// Due dates are stored either as a date (2006-01-02), meaning the task is
+// due by the end of that day, or as an RFC3339 time.
+const dateFormat = "2006-01-02"
+
+var (
+	spanPattern = regexp.MustCompile(`^\+?(\d+)\s*(h|d|w|mo|y)$`)
+	weekdays    = map[string]time.Weekday{}
+
+	// Set from --due-before and --due-within.
+	dueBefore time.Time
+	dueWithin time.Time
+)
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		weekdays[name] = d
+		weekdays[name[:3]] = d
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func formatDate(t time.Time) string {
+	return t.Format(dateFormat)
+}
+
+// addSpan adds a span like "3d" or "2w" to t. Spans in whole days keep t
+// a date. A month after January 31 is the end of February, not early
+// March.
+func addSpan(t time.Time, span string) (time.Time, bool, error) {
+	m := spanPattern.FindStringSubmatch(span)
+	if m == nil {
+		return t, false, fmt.Errorf("cannot understand '%s' as a span; use e.g. 12h, 3d, 2w, 1mo or 1y", span)
+	}
+	n, _ := strconv.Atoi(m[1])
+	switch m[2] {
+	case "h":
+		return t.Add(time.Duration(n) * time.Hour), false, nil
+	case "d":
+		return t.AddDate(0, 0, n), true, nil
+	case "w":
+		return t.AddDate(0, 0, 7*n), true, nil
+	case "mo":
+		return addMonths(t, n), true, nil
+	default:
+		return addMonths(t, 12*n), true, nil
+	}
+}
+
+// addMonths adds n months to t, keeping to the last day of a shorter
+// month.
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	day := t.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// parseWhen turns a due date as the user wrote it into the stored form.
+// Besides RFC3339 times and dates it understands today, tomorrow,
+// yesterday, weekdays (the next one after today), spans from now like +3d
+// and end of week/month/year.
+func parseWhen(value string, now time.Time) (string, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Format(time.RFC3339), nil
+	}
+	if t, err := time.ParseInLocation(dateFormat, value, time.Local); err == nil {
+		return formatDate(t), nil
+	}
+
+	phrase := strings.Join(strings.Fields(strings.ToLower(value)), " ")
+	today := startOfDay(now)
+	switch phrase {
+	case "today", "eod", "end of day":
+		return formatDate(today), nil
+	case "tomorrow":
+		return formatDate(today.AddDate(0, 0, 1)), nil
+	case "yesterday":
+		return formatDate(today.AddDate(0, 0, -1)), nil
+	case "eow", "end of week":
+		days := (7 - int(today.Weekday())) % 7
+		return formatDate(today.AddDate(0, 0, days)), nil
+	case "eom", "end of month":
+		return formatDate(today.AddDate(0, 1, -today.Day())), nil
+	case "eoy", "end of year":
+		return formatDate(time.Date(today.Year(), time.December, 31, 0, 0, 0, 0, today.Location())), nil
+	}
+
+	if d, ok := weekdays[strings.TrimPrefix(phrase, "next ")]; ok {
+		days := (int(d)-int(today.Weekday())+6)%7 + 1
+		return formatDate(today.AddDate(0, 0, days)), nil
+	}
+	if spanPattern.MatchString(phrase) {
+		t, isDate, err := addSpan(now, phrase)
+		if err != nil {
+			return "", err
+		}
+		if isDate {
+			return formatDate(t), nil
+		}
+		return t.Format(time.RFC3339), nil
+	}
+	return "", fmt.Errorf("cannot understand '%s' as a date; use e.g. 2026-11-01, tomorrow, fri, +3d or end of month", value)
+}
+
+// dueEnd returns the moment a task is due: the given time, or the end of
+// the due date.
+func dueEnd(due string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, due); err == nil {
+		return t, true
+	}
+	if t, err := time.ParseInLocation(dateFormat, due, time.Local); err == nil {
+		return t.AddDate(0, 0, 1), true
+	}
+	return time.Time{}, false
+}
+
+// taskDue returns the moment the task is due, if it has a due date.
+func taskDue(task Task) (time.Time, bool) {
+	return dueEnd(task.Due)
+}
+
+func (t *Task) IsOverdue(now time.Time) bool {
+	due, ok := taskDue(*t)
+	return ok && !t.IsDone() && !now.Before(due)
+}
+
+func (t *Task) HumanDue() string {
+	due, ok := taskDue(*t)
+	if !ok {
+		return t.Due
+	}
+	return t.Due + " (" + humanize.Time(due) + ")"
+}
+
+// dueCell shows the due date of a task in a table, marking it when the
+// task is overdue; in red on a terminal.
+func dueCell(task Task, now time.Time) string {
+	if task.Due == "" {
+		return ""
+	}
+	cell := task.HumanDue()
+	if !task.IsOverdue(now) {
+		return cell
+	}
+	cell += " OVERDUE"
+	if isTerminal(os.Stdout) {
+		cell = "\033[31m" + cell + "\033[0m"
+	}
+	return cell
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// parseDueFilters parses --due-before and --due-within.
+func parseDueFilters(now time.Time) error {
+	if *dueBeforeFlag != "" {
+		when, err := parseWhen(*dueBeforeFlag, now)
+		if err != nil {
+			return err
+		}
+		// A date means before that day starts.
+		if t, err := time.ParseInLocation(dateFormat, when, time.Local); err == nil {
+			dueBefore = t
+		} else {
+			dueBefore, _ = time.Parse(time.RFC3339, when)
+		}
+	}
+	if *dueWithinFlag != "" {
+		t, _, err := addSpan(now, strings.ToLower(*dueWithinFlag))
+		if err != nil {
+			return err
+		}
+		dueWithin = t
+	}
+	return nil
+}
+
+// matchesDueFilters tells whether a task passes --overdue, --due-before
+// and --due-within. Tasks without a due date only pass when none of them
+// is given; overdue tasks are due within any span.
+func matchesDueFilters(task Task, now time.Time) bool {
+	if !*onlyOverdue && dueBefore.IsZero() && dueWithin.IsZero() {
+		return true
+	}
+	due, ok := taskDue(task)
+	if !ok {
+		return false
+	}
+	if *onlyOverdue && !task.IsOverdue(now) {
+		return false
+	}
+	if !dueBefore.IsZero() && due.After(dueBefore) {
+		return false
+	}
+	if !dueWithin.IsZero() && due.After(dueWithin) {
+		return false
+	}
+	return true
+}
+
+func setTaskDue(s Storage, name string, whenArray []string) {
+	when := strings.Join(whenArray, " ")
+	if when == "none" {
+		when = ""
+	}
+	if when != "" {
+		var err error
+		if when, err = parseWhen(when, time.Now()); err != nil {
+			print(err.Error() + "\n")
+			return
+		}
+	}
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		task.Due = when
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 14, 30, 0, 0, time.Local)
+}
+
+func TestParseWhen(t *testing.T) {
+	friday := date(2026, time.October, 16)
+	sunday := date(2026, time.October, 18)
+	tests := []struct {
+		value string
+		now   time.Time
+		want  string
+	}{
+		{"2026-11-01", friday, "2026-11-01"},
+		{"2026-11-01T09:00:00+02:00", friday, "2026-11-01T09:00:00+02:00"},
+		{"today", friday, "2026-10-16"},
+		{"  End  of   Day ", friday, "2026-10-16"},
+		{"tomorrow", friday, "2026-10-17"},
+		{"yesterday", friday, "2026-10-15"},
+
+		// A weekday is the next one after today, never today.
+		{"fri", friday, "2026-10-23"},
+		{"friday", friday, "2026-10-23"},
+		{"next fri", friday, "2026-10-23"},
+		{"sat", friday, "2026-10-17"},
+		{"thu", friday, "2026-10-22"},
+		{"sun", sunday, "2026-10-25"},
+		{"mon", sunday, "2026-10-19"},
+
+		// Weeks end on Sunday.
+		{"eow", friday, "2026-10-18"},
+		{"end of week", sunday, "2026-10-18"},
+
+		{"eom", friday, "2026-10-31"},
+		{"end of month", date(2026, time.January, 31), "2026-01-31"},
+		{"eom", date(2026, time.February, 1), "2026-02-28"},
+		{"eom", date(2024, time.February, 10), "2024-02-29"},
+		{"eom", date(2026, time.December, 15), "2026-12-31"},
+		{"eoy", friday, "2026-12-31"},
+		{"end of year", date(2026, time.December, 31), "2026-12-31"},
+
+		{"+3d", friday, "2026-10-19"},
+		{"3d", friday, "2026-10-19"},
+		{"+2w", friday, "2026-10-30"},
+		{"+1mo", friday, "2026-11-16"},
+		{"+1mo", date(2026, time.January, 31), "2026-02-28"},
+		{"+1mo", date(2024, time.January, 30), "2024-02-29"},
+		{"+3mo", date(2026, time.November, 30), "2027-02-28"},
+		{"+1y", date(2024, time.February, 29), "2025-02-28"},
+		{"+12h", friday, friday.Add(12 * time.Hour).Format(time.RFC3339)},
+	}
+	for _, test := range tests {
+		got, err := parseWhen(test.value, test.now)
+		if err != nil {
+			t.Errorf("parseWhen(%q, %s): %v", test.value, formatDate(test.now), err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseWhen(%q, %s) = %s, want %s", test.value, formatDate(test.now), got, test.want)
+		}
+	}
+}
+
+func TestParseWhenInvalid(t *testing.T) {
+	for _, value := range []string{"", "someday", "3x", "+d", "2026-13-01", "next"} {
+		if got, err := parseWhen(value, date(2026, time.October, 16)); err == nil {
+			t.Errorf("parseWhen(%q) = %s, want an error", value, got)
+		}
+	}
+}
+
+func TestDueEnd(t *testing.T) {
+	tests := []struct {
+		due  string
+		want time.Time
+		ok   bool
+	}{
+		{"2026-10-16", time.Date(2026, time.October, 17, 0, 0, 0, 0, time.Local), true},
+		{"2026-12-31", time.Date(2027, time.January, 1, 0, 0, 0, 0, time.Local), true},
+		{"2026-10-16T09:00:00Z", time.Date(2026, time.October, 16, 9, 0, 0, 0, time.UTC), true},
+		{"", time.Time{}, false},
+		{"soon", time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, ok := dueEnd(test.due)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("dueEnd(%q) = %v, %v, want %v, %v", test.due, got, ok, test.want, test.ok)
+		}
+	}
+}
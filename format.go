@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// currentFormatVersion is the version of the task file format written by
+// this version of task. Raise it together with a new entry in migrations
+// whenever a change to Task would not read older files correctly.
+const currentFormatVersion = 5
+
+// A migration upgrades a task from the previous format version to
+// Version. Tasks are handed over as decoded JSON, before they are turned
+// into a Task.
+//
+// The directory and bolt layouts upgrade tasks one by one as they are
+// read, so a migration must leave a task that is already in the new
+// format alone.
+type migration struct {
+	Version     int
+	Description string
+	Task        func(task map[string]interface{}) error
+}
+
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "Add a format version to the task file",
+	},
+	{
+		Version:     2,
+		Description: "Move the 'due' field to the due date of the task",
+		Task:        migrateDueField,
+	},
+	{
+		Version:     3,
+		Description: "Move the 'estimate' field to the estimate of the task",
+		Task:        migrateEstimateField,
+	},
+	{
+		Version:     4,
+		Description: "Turn the single assignee into a list of assignees",
+		Task:        migrateAssignee,
+	},
+	{
+		Version:     5,
+		Description: "Give every comment an ID",
+		Task:        migrateCommentIDs,
+	},
+}
+
+// migrateCommentIDs gives the comments of a task that have none an ID.
+func migrateCommentIDs(task map[string]interface{}) error {
+	comments, _ := task["comments"].([]interface{})
+	taken := map[string]bool{}
+	for _, c := range comments {
+		if c, ok := c.(map[string]interface{}); ok && c["id"] != nil {
+			taken[fmt.Sprint(c["id"])] = true
+		}
+	}
+	for _, c := range comments {
+		c, ok := c.(map[string]interface{})
+		if !ok || c["id"] != nil {
+			continue
+		}
+		text := func(key string) string {
+			if c[key] == nil {
+				return ""
+			}
+			return fmt.Sprint(c[key])
+		}
+		id := commentID(text("by"), text("at"), text("comment"), func(id string) bool {
+			return taken[id]
+		})
+		c["id"] = id
+		taken[id] = true
+	}
+	return nil
+}
+
+// migrateAssignee turns the "assignee" of a task into "assignees".
+func migrateAssignee(task map[string]interface{}) error {
+	assignee, ok := task["assignee"]
+	if !ok {
+		return nil
+	}
+	delete(task, "assignee")
+	if _, ok := task["assignees"]; ok {
+		return nil
+	}
+	if user := fmt.Sprint(assignee); assignee != nil && user != "" {
+		task["assignees"] = []interface{}{user}
+	}
+	return nil
+}
+
+// migrateEstimateField turns an "estimate" field that holds a number into
+// the estimate of the task.
+func migrateEstimateField(task map[string]interface{}) error {
+	fields, ok := task["fields"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if _, ok := task["estimate"]; ok {
+		return nil
+	}
+	value, ok := fields["estimate"]
+	if !ok {
+		return nil
+	}
+	// Hand-written numbers are not strings in YAML.
+	estimate, err := parseAmount(fmt.Sprint(value))
+	if err != nil {
+		return nil
+	}
+	task["estimate"] = estimate
+	delete(fields, "estimate")
+	if len(fields) == 0 {
+		delete(task, "fields")
+	}
+	return nil
+}
+
+// migrateDueField turns a "due" field that holds a date into the due date
+// of the task. Other values stay a field.
+func migrateDueField(task map[string]interface{}) error {
+	fields, ok := task["fields"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if _, ok := task["due"]; ok {
+		return nil
+	}
+	value, ok := fields["due"].(string)
+	if !ok {
+		return nil
+	}
+	if _, ok := dueEnd(value); !ok {
+		return nil
+	}
+	task["due"] = value
+	delete(fields, "due")
+	if len(fields) == 0 {
+		delete(task, "fields")
+	}
+	return nil
+}
+
+// formatVersioned is implemented by storages that know the format
+// version of what they have stored.
+type formatVersioned interface {
+	StoredVersion() (int, error)
+}
+
+type errNewerFormat struct {
+	version int
+}
+
+func (e errNewerFormat) Error() string {
+	return fmt.Sprintf("the task file has format version %d, but this version of task only understands up to version %d; please upgrade task", e.version, currentFormatVersion)
+}
+
+func checkFormatVersion(version int) error {
+	if version > currentFormatVersion {
+		return errNewerFormat{version: version}
+	}
+	return nil
+}
+
+// pendingMigrations returns the migrations needed to upgrade from the
+// given format version.
+func pendingMigrations(from int) []migration {
+	pending := []migration{}
+	for _, m := range migrations {
+		if m.Version > from {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+func migrateTask(raw map[string]interface{}, from int) error {
+	for _, m := range pendingMigrations(from) {
+		if m.Task == nil {
+			continue
+		}
+		if err := m.Task(raw); err != nil {
+			return fmt.Errorf("migrating to version %d: %v", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// decodeTask turns a task in the given format version into a Task.
+func decodeTask(raw interface{}, from int) (Task, error) {
+	var task Task
+	m, ok := normalize(raw).(map[string]interface{})
+	if !ok {
+		if raw == nil {
+			return task, nil
+		}
+		return task, fmt.Errorf("task is not a map")
+	}
+	if err := migrateTask(m, from); err != nil {
+		return task, err
+	}
+	// Going through YAML rather than JSON keeps hand-written values
+	// such as "priority: 3" working for string properties.
+	dat, err := yaml.Marshal(m)
+	if err != nil {
+		return task, err
+	}
+	err = yaml.Unmarshal(dat, &task)
+	return task, err
+}
+
+// decodeTaskData is decodeTask for a single serialized task.
+func decodeTaskData(c codec, dat []byte, from int) (Task, error) {
+	var raw interface{}
+	if err := c.Unmarshal(dat, &raw); err != nil {
+		return Task{}, err
+	}
+	return decodeTask(raw, from)
+}
+
+// decodeConfig turns a whole task file into a TaskConfig, upgrading it
+// to the current format version.
+func decodeConfig(c codec, dat []byte) (TaskConfig, error) {
+	conf := TaskConfig{Tasks: map[string]Task{}}
+
+	var raw interface{}
+	if err := c.Unmarshal(dat, &raw); err != nil {
+		return conf, err
+	}
+	doc, _ := normalize(raw).(map[string]interface{})
+
+	version := formatVersion(doc)
+	if err := checkFormatVersion(version); err != nil {
+		return conf, err
+	}
+
+	for key, v := range map[string]interface{}{"schema": &conf.Schema, "workflow": &conf.Workflow} {
+		section, ok := doc[key]
+		if !ok {
+			continue
+		}
+		dat, err := yaml.Marshal(section)
+		if err == nil {
+			err = yaml.Unmarshal(dat, v)
+		}
+		if err != nil {
+			return conf, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	tasks, _ := doc["tasks"].(map[string]interface{})
+	for name, t := range tasks {
+		task, err := decodeTask(t, version)
+		if err != nil {
+			return conf, fmt.Errorf("task '%s': %v", name, err)
+		}
+		conf.Tasks[name] = task
+	}
+	conf.Version = currentFormatVersion
+
+	return conf, nil
+}
+
+// formatVersion reads the version from a decoded file header; files
+// from before versioning have none and are version 0.
+func formatVersion(doc map[string]interface{}) int {
+	switch v := doc["version"].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+// normalize converts the map[interface{}]interface{} values produced by
+// the YAML decoder into map[string]interface{}, as used for JSON.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range v {
+			m[fmt.Sprint(k)] = normalize(val)
+		}
+		return m
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = normalize(val)
+		}
+		return v
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalize(val)
+		}
+		return v
+	}
+	return v
+}
+
+func migrateTasks(s Storage, dryRun bool) {
+	version := 0
+	if fv, ok := s.(formatVersioned); ok {
+		var err error
+		if version, err = fv.StoredVersion(); err != nil {
+			panic(err)
+		}
+	}
+
+	pending := pendingMigrations(version)
+	if len(pending) == 0 {
+		print("Task file is at format version " + strconv.Itoa(version) + "; nothing to migrate\n")
+		return
+	}
+	for _, m := range pending {
+		fmt.Printf("%d -> %d: %s\n", m.Version-1, m.Version, m.Description)
+	}
+	if dryRun {
+		return
+	}
+
+	// Loading upgrades every task; saving writes them and the new
+	// version back.
+	conf, err := s.Load()
+	if err != nil {
+		panic(err)
+	}
+	if err = s.Save(&conf); err != nil {
+		panic(err)
+	}
+	print("Migrated " + strconv.Itoa(len(conf.Tasks)) + " tasks to format version " + strconv.Itoa(currentFormatVersion) + "\n")
+}
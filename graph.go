@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// stateColors are the fill colors of the nodes in a dependency graph.
+var stateColors = map[string]string{
+	"":            "#ffffff",
+	"todo":        "#ffffff",
+	"in-progress": "#ffe08a",
+	"done":        "#b5e7a0",
+}
+
+const otherStateColor = "#d0d0d0"
+
+func stateColor(state string) string {
+	if color, ok := stateColors[state]; ok {
+		return color
+	}
+	if activeWorkflow.IsClosed(state) {
+		return stateColors["done"]
+	}
+	return otherStateColor
+}
+
+// graphTasks returns the names of the tasks matching the filters, sorted.
+func graphTasks(conf *TaskConfig) []string {
+	names := []string{}
+	for name, task := range conf.Tasks {
+		if matchesFilters(task) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func showGraph(conf *TaskConfig, format string) {
+	names := graphTasks(conf)
+	switch format {
+	case "dot":
+		fmt.Print(dotGraph(conf, names))
+	case "mermaid":
+		fmt.Print(mermaidGraph(conf, names))
+	}
+}
+
+func nodeLabel(task Task) []string {
+	label := []string{task.Title}
+	if len(task.Assignees) > 0 {
+		label = append(label, "("+joinPeople(task.Assignees)+")")
+	}
+	return label
+}
+
+// dotGraph renders the tasks as a Graphviz digraph; every arrow points
+// from a task to the task waiting for it.
+func dotGraph(conf *TaskConfig, names []string) string {
+	var b strings.Builder
+	included := map[string]bool{}
+	for _, name := range names {
+		included[name] = true
+	}
+
+	b.WriteString("digraph tasks {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, style=\"rounded,filled\"];\n")
+	for _, name := range names {
+		task := conf.Tasks[name]
+		label := strings.Join(nodeLabel(task), "\n")
+		fmt.Fprintf(&b, "  %s [label=%s, fillcolor=%s];\n", dotQuote(name), dotQuote(name+": "+label), dotQuote(stateColor(task.State)))
+	}
+	for _, name := range names {
+		for _, after := range conf.Tasks[name].AfterTasks {
+			if included[after] {
+				fmt.Fprintf(&b, "  %s -> %s;\n", dotQuote(after), dotQuote(name))
+			}
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func dotQuote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return "\"" + s + "\""
+}
+
+// mermaidGraph renders the tasks as a Mermaid flowchart. Task names can
+// contain anything, so nodes get generated ids and the name goes in the
+// label.
+func mermaidGraph(conf *TaskConfig, names []string) string {
+	var b strings.Builder
+	ids := map[string]string{}
+	for i, name := range names {
+		ids[name] = "t" + strconv.Itoa(i)
+	}
+
+	b.WriteString("flowchart LR\n")
+	classes := map[string][]string{}
+	for _, name := range names {
+		task := conf.Tasks[name]
+		label := strings.Join(nodeLabel(task), "<br/>")
+		fmt.Fprintf(&b, "  %s[\"%s\"]\n", ids[name], mermaidEscape(name+": "+label))
+		class := mermaidClass(task.State)
+		classes[class] = append(classes[class], ids[name])
+	}
+	for _, name := range names {
+		for _, after := range conf.Tasks[name].AfterTasks {
+			if id, ok := ids[after]; ok {
+				fmt.Fprintf(&b, "  %s --> %s\n", id, ids[name])
+			}
+		}
+	}
+
+	states := []string{}
+	for _, task := range conf.Tasks {
+		if !contains(states, task.State) {
+			states = append(states, task.State)
+		}
+	}
+	sort.Strings(states)
+	for _, state := range states {
+		class := mermaidClass(state)
+		if len(classes[class]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "  classDef %s fill:%s,stroke:#555\n", class, stateColor(state))
+		fmt.Fprintf(&b, "  class %s %s\n", strings.Join(classes[class], ","), class)
+	}
+	return b.String()
+}
+
+// mermaidClass returns the class name for the tasks in state. Letters and
+// digits are kept, anything else is written as its code point between
+// underscores, so different states never share a class.
+func mermaidClass(state string) string {
+	var b strings.Builder
+	b.WriteString("state_")
+	for _, r := range state {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		} else {
+			fmt.Fprintf(&b, "_%x_", r)
+		}
+	}
+	return b.String()
+}
+
+func mermaidEscape(s string) string {
+	s = strings.Replace(s, "\"", "#quot;", -1)
+	return s
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+type HistoryEntry struct {
+	At     string `json:"at"`
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	Field  string `json:"field"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// taskHistory lists every recorded change of a task, oldest first.
+func taskHistory(file string, name string) []HistoryEntry {
+	j := &Journal{file: journalFile(file)}
+	events, err := j.Events()
+	if err != nil {
+		panic(err)
+	}
+
+	history := []HistoryEntry{}
+	for _, e := range events {
+		if e.Task != name {
+			continue
+		}
+		for _, c := range e.Changes {
+			history = append(history, HistoryEntry{
+				At:     e.At,
+				Actor:  e.Actor,
+				Action: e.Action,
+				Field:  c.Field,
+				Old:    c.Old,
+				New:    c.New,
+			})
+		}
+	}
+	return history
+}
+
+func showHistory(file string, name string) {
+	history := taskHistory(file, name)
+	switch *exportFormat {
+	case "table":
+		showHistoryTable(name, history)
+	case "json":
+		res, _ := json.Marshal(history)
+		fmt.Println(string(res))
+	}
+}
+
+func showHistoryTable(name string, history []HistoryEntry) {
+	if len(history) == 0 {
+		print("No history for task '" + name + "'\n")
+		return
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetColWidth(100)
+	table.SetHeader([]string{"When", "Who", "Action", "Field", "Old", "New"})
+	for _, h := range history {
+		table.Append([]string{h.At + " (" + humanAt(h.At) + ")", h.Actor, h.Action, h.Field, h.Old, h.New})
+	}
+	table.Render()
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Event is a single mutation of a task, as recorded in the journal. The
+// full task before and after the change is kept, so the task file can be
+// rebuilt by replaying the journal; Changes is the human readable summary.
+type Event struct {
+	Seq int `json:"seq"`
+	// Tx is the sequence number of the first event written by the same
+	// command.
+	Tx int `json:"tx,omitempty"`
+	// Format is the format version of the tasks in Before and After.
+	Format  int      `json:"format,omitempty"`
+	At      string   `json:"at"`
+	Actor   string   `json:"actor"`
+	Action  string   `json:"action"`
+	Task    string   `json:"task"`
+	Changes []Change `json:"changes,omitempty"`
+	Before  *Task    `json:"before,omitempty"`
+	After   *Task    `json:"after,omitempty"`
+	// Undoes or Redoes refer to the Tx of the mutation this event
+	// reverts or re-applies.
+	Undoes int `json:"undoes,omitempty"`
+	Redoes int `json:"redoes,omitempty"`
+}
+
+type Change struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// Journal is an append-only file of events, one JSON object per line.
+type Journal struct {
+	file string
+}
+
+func journalFile(file string) string {
+	return filepath.Clean(file) + ".journal"
+}
+
+func (j *Journal) exists() bool {
+	_, err := os.Stat(j.file)
+	return err == nil
+}
+
+// Append writes the events to the journal, numbering them after the last
+// recorded event.
+func (j *Journal) Append(events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	last, err := j.lastSeq()
+	if err != nil {
+		return err
+	}
+
+	var lines []byte
+	tx := last + 1
+	for i := range events {
+		last++
+		events[i].Seq = last
+		events[i].Tx = tx
+		line, err := json.Marshal(events[i])
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	f, err := os.OpenFile(j.file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if !endsWithNewline(f) {
+		lines = append([]byte{'\n'}, lines...)
+	}
+	if _, err = f.Write(lines); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func endsWithNewline(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return true
+	}
+	last := make([]byte, 1)
+	if _, err = f.ReadAt(last, info.Size()-1); err != nil {
+		return true
+	}
+	return last[0] == '\n'
+}
+
+// Events returns all recorded events, oldest first.
+func (j *Journal) Events() ([]Event, error) {
+	events := []Event{}
+	f, err := os.Open(j.file)
+	if os.IsNotExist(err) {
+		return events, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			e, jerr := decodeEvent(line)
+			if jerr != nil {
+				// Only a crash halfway through an append leaves a
+				// damaged line behind; the events around it are fine.
+				fmt.Fprintf(os.Stderr, "%s:%d: skipping damaged event: %v\n", j.file, n, jerr)
+			} else {
+				events = append(events, e)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// decodeEvent reads a journal line, upgrading the tasks in it to the
+// current format version.
+func decodeEvent(line []byte) (Event, error) {
+	var raw struct {
+		Event
+		Before json.RawMessage `json:"before"`
+		After  json.RawMessage `json:"after"`
+	}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return raw.Event, err
+	}
+	e := raw.Event
+	for _, t := range []struct {
+		dat  json.RawMessage
+		task **Task
+	}{{raw.Before, &e.Before}, {raw.After, &e.After}} {
+		if len(t.dat) == 0 || string(t.dat) == "null" {
+			continue
+		}
+		task, err := decodeTaskData(jsonCodec{}, t.dat, e.Format)
+		if err != nil {
+			return e, err
+		}
+		*t.task = &task
+	}
+	e.Format = currentFormatVersion
+	return e, nil
+}
+
+// lastSeq reads the journal backwards to find the number of the last
+// event, so appending does not need to read the whole journal.
+func (j *Journal) lastSeq() (int, error) {
+	f, err := os.Open(j.file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := info.Size()
+	var tail []byte
+	for end > 0 {
+		size := int64(4096)
+		if size > end {
+			size = end
+		}
+		end -= size
+		chunk := make([]byte, size)
+		if _, err := f.ReadAt(chunk, end); err != nil {
+			return 0, err
+		}
+		tail = append(chunk, tail...)
+
+		// The last complete line sits between the last two newlines.
+		trimmed := tail
+		for len(trimmed) > 0 && trimmed[len(trimmed)-1] == '\n' {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+		if i := lastIndexByte(trimmed, '\n'); i >= 0 || end == 0 {
+			var e Event
+			if err := json.Unmarshal(trimmed[i+1:], &e); err != nil {
+				return j.lastValidSeq()
+			}
+			return e.Seq, nil
+		}
+	}
+	return 0, nil
+}
+
+func (j *Journal) lastValidSeq() (int, error) {
+	events, err := j.Events()
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+	return events[len(events)-1].Seq, nil
+}
+
+func lastIndexByte(b []byte, c byte) int {
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// journalStorage records every change made through the wrapped storage
+// in the journal.
+type journalStorage struct {
+	Storage
+	journal *Journal
+	action  string
+	// undoes and redoes are copied to the events of the next
+	// transaction.
+	undoes int
+	redoes int
+}
+
+func newJournalStorage(s Storage, file string, action string) *journalStorage {
+	return &journalStorage{Storage: s, journal: &Journal{file: journalFile(file)}, action: action}
+}
+
+func (js *journalStorage) PutTask(name string, task Task) error {
+	return js.Transaction(func(tx Storage) error {
+		return tx.PutTask(name, task)
+	})
+}
+
+func (js *journalStorage) DeleteTask(name string) error {
+	return js.Transaction(func(tx Storage) error {
+		return tx.DeleteTask(name)
+	})
+}
+
+func (js *journalStorage) Save(conf *TaskConfig) error {
+	return js.Transaction(func(tx Storage) error {
+		return tx.Save(conf)
+	})
+}
+
+func (js *journalStorage) SubtaskStates(parent string) ([]string, error) {
+	return subtaskStates(js.Storage, parent)
+}
+
+func (js *journalStorage) GetTasks(names []string) (map[string]Task, error) {
+	return getTasks(js.Storage, names)
+}
+
+func (js *journalStorage) Header() (TaskConfig, error) {
+	return loadHeader(js.Storage)
+}
+
+func (js *journalStorage) Transaction(fn func(tx Storage) error) error {
+	if err := js.startJournal(); err != nil {
+		return err
+	}
+
+	return js.Storage.Transaction(func(tx Storage) error {
+		events := []Event{}
+		jtx := &journalTx{Storage: tx, before: map[string]*Task{}}
+		if err := fn(jtx); err != nil {
+			return err
+		}
+		for name, before := range jtx.before {
+			after, ok, err := tx.GetTask(name)
+			if err != nil {
+				return err
+			}
+			if before == nil && !ok || before != nil && ok && sameTask(*before, after) {
+				continue
+			}
+			e := newEvent(js.action, name, before, nil)
+			if ok {
+				e.After = &after
+			}
+			e.Changes = diffTasks(e.Before, e.After)
+			e.Undoes, e.Redoes = js.undoes, js.redoes
+			events = append(events, e)
+		}
+		// The events are written ahead of the snapshot: if this fails,
+		// nothing is saved, and the snapshot is never ahead of the
+		// journal.
+		sort.Slice(events, func(i, j int) bool { return events[i].Task < events[j].Task })
+		return js.journal.Append(events)
+	})
+}
+
+// startJournal records the current state of all tasks when there is no
+// journal yet, so replaying it also restores tasks that never changed
+// afterwards.
+func (js *journalStorage) startJournal() error {
+	if js.journal.exists() {
+		return nil
+	}
+	conf, err := js.Storage.Load()
+	if err != nil {
+		return err
+	}
+	events := []Event{}
+	for name, task := range conf.Tasks {
+		task := task
+		e := newEvent("import", name, nil, &task)
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Task < events[j].Task })
+	return js.journal.Append(events)
+}
+
+func newEvent(action string, name string, before *Task, after *Task) Event {
+	return Event{
+		Format: currentFormatVersion,
+		At:     time.Now().Format(time.RFC3339),
+		Actor:  parseUser("me"),
+		Action: action,
+		Task:   name,
+		Before: before,
+		After:  after,
+	}
+}
+
+// journalTx remembers the state of every task before it is first changed
+// in a transaction.
+type journalTx struct {
+	Storage
+	before map[string]*Task
+}
+
+func (t *journalTx) Header() (TaskConfig, error) {
+	return loadHeader(t.Storage)
+}
+
+func (t *journalTx) remember(name string) error {
+	if _, ok := t.before[name]; ok {
+		return nil
+	}
+	task, ok, err := t.Storage.GetTask(name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		t.before[name] = &task
+	} else {
+		t.before[name] = nil
+	}
+	return nil
+}
+
+func (t *journalTx) PutTask(name string, task Task) error {
+	if err := t.remember(name); err != nil {
+		return err
+	}
+	return t.Storage.PutTask(name, task)
+}
+
+func (t *journalTx) DeleteTask(name string) error {
+	if err := t.remember(name); err != nil {
+		return err
+	}
+	return t.Storage.DeleteTask(name)
+}
+
+func (t *journalTx) Save(conf *TaskConfig) error {
+	current, err := t.Storage.Load()
+	if err != nil {
+		return err
+	}
+	for name := range current.Tasks {
+		if err := t.remember(name); err != nil {
+			return err
+		}
+	}
+	for name := range conf.Tasks {
+		if err := t.remember(name); err != nil {
+			return err
+		}
+	}
+	return t.Storage.Save(conf)
+}
+
+func (t *journalTx) Transaction(fn func(tx Storage) error) error {
+	return fn(t)
+}
+
+// diffTasks lists the changed properties between two versions of a task.
+// Custom fields are compared one by one, and comments are listed as they
+// are added, changed or removed. A deleted task is a single change.
+func diffTasks(before *Task, after *Task) []Change {
+	if before != nil && after == nil {
+		return []Change{{Field: "deleted", Old: before.Title}}
+	}
+
+	old := taskValues(before)
+	cur := taskValues(after)
+
+	keys := []string{}
+	for k := range old {
+		keys = append(keys, k)
+	}
+	for k := range cur {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []Change{}
+	for _, k := range keys {
+		if old[k] != cur[k] {
+			changes = append(changes, Change{Field: k, Old: old[k], New: cur[k]})
+		}
+	}
+
+	var beforeComments []TaskComment
+	if before != nil {
+		beforeComments = before.Comments
+	}
+	oldComments := map[string]TaskComment{}
+	for _, c := range beforeComments {
+		oldComments[commentKey(c)] = c
+	}
+	for _, c := range after.Comments {
+		old, ok := oldComments[commentKey(c)]
+		delete(oldComments, commentKey(c))
+		if !ok || old.Comment != c.Comment {
+			changes = append(changes, Change{Field: "comment", Old: old.Comment, New: c.Comment})
+		}
+	}
+	for _, c := range beforeComments {
+		if old, ok := oldComments[commentKey(c)]; ok && !old.Deleted {
+			changes = append(changes, Change{Field: "comment", Old: old.Comment})
+		}
+	}
+
+	// Work entries are told apart by who started them when.
+	oldWork := map[string]WorkEntry{}
+	if before != nil {
+		for _, w := range before.Worklog {
+			oldWork[w.User+"\x00"+w.Start] = w
+		}
+	}
+	for _, w := range after.Worklog {
+		key := w.User + "\x00" + w.Start
+		if o, ok := oldWork[key]; !ok {
+			changes = append(changes, Change{Field: "worklog", New: w.String()})
+		} else if o != w {
+			changes = append(changes, Change{Field: "worklog", Old: o.String(), New: w.String()})
+		}
+		delete(oldWork, key)
+	}
+	for _, w := range oldWork {
+		changes = append(changes, Change{Field: "worklog", Old: w.String()})
+	}
+	return changes
+}
+
+// taskValues flattens a task to property/value pairs for diffTasks,
+// leaving out the bookkeeping timestamps.
+func taskValues(task *Task) map[string]string {
+	values := map[string]string{}
+	if task == nil {
+		return values
+	}
+
+	var raw map[string]interface{}
+	dat, _ := json.Marshal(task)
+	json.Unmarshal(dat, &raw)
+	for k, v := range raw {
+		switch k {
+		case "created_at", "updated_at", "revision", "comments", "worklog":
+		case "fields":
+			for fk, fv := range v.(map[string]interface{}) {
+				values["fields."+fk] = formatValue(fv)
+			}
+		default:
+			values[k] = formatValue(v)
+		}
+	}
+	return values
+}
+
+func formatValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	dat, _ := json.Marshal(v)
+	return string(dat)
+}
+
+// rebuildTasks replays the journal and replaces all tasks with the
+// result.
+func rebuildTasks(s Storage, file string) {
+	j := &Journal{file: journalFile(file)}
+	if !j.exists() {
+		print("No journal '" + j.file + "' found\n")
+		return
+	}
+	events, err := j.Events()
+	if err != nil {
+		panic(err)
+	}
+
+	conf := replay(events)
+	// The journal only records tasks.
+	current, err := s.Load()
+	if err != nil {
+		panic(err)
+	}
+	conf.Schema = current.Schema
+	conf.Workflow = current.Workflow
+	if err = s.Save(&conf); err != nil {
+		panic(err)
+	}
+	print("Rebuilt " + strconv.Itoa(len(conf.Tasks)) + " tasks from " + strconv.Itoa(len(events)) + " events\n")
+}
+
+func replay(events []Event) TaskConfig {
+	conf := TaskConfig{Tasks: map[string]Task{}}
+	for _, e := range events {
+		if e.After == nil {
+			delete(conf.Tasks, e.Task)
+		} else {
+			conf.Tasks[e.Task] = *e.After
+		}
+	}
+	return conf
+}
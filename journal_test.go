@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Replaying the journal gives the tasks that are in the file, whatever
+// was done to them.
+func TestReplayMatchesFile(t *testing.T) {
+	put := func(name string, task Task) func(s Storage) error {
+		return func(s Storage) error { return s.PutTask(name, task) }
+	}
+	remove := func(name string) func(s Storage) error {
+		return func(s Storage) error { return s.DeleteTask(name) }
+	}
+	save := func(tasks map[string]Task) func(s Storage) error {
+		return func(s Storage) error { return s.Save(&TaskConfig{Tasks: tasks}) }
+	}
+	tests := []struct {
+		name     string
+		existing string
+		changes  []func(s Storage) error
+	}{
+		{"created", "", []func(s Storage) error{
+			put("a", Task{Title: "A"}),
+			put("b", Task{Title: "B", Tags: []string{"x"}, Fields: map[string]string{"prio": "1"}}),
+		}},
+		{"changed", "", []func(s Storage) error{
+			put("a", Task{Title: "A"}),
+			put("a", Task{Title: "A", State: "done", Revision: 2}),
+		}},
+		{"deleted", "", []func(s Storage) error{
+			put("a", Task{Title: "A"}),
+			put("b", Task{Title: "B"}),
+			remove("a"),
+		}},
+		{"deleted and created again", "", []func(s Storage) error{
+			put("a", Task{Title: "A"}),
+			remove("a"),
+			put("a", Task{Title: "A again"}),
+		}},
+		{"saved all at once", "", []func(s Storage) error{
+			put("a", Task{Title: "A"}),
+			save(map[string]Task{"b": {Title: "B"}, "c": {Title: "C", AfterTasks: []string{"b"}}}),
+		}},
+		{"in a transaction", "", []func(s Storage) error{
+			func(s Storage) error {
+				return s.Transaction(func(tx Storage) error {
+					if err := tx.PutTask("a", Task{Title: "A"}); err != nil {
+						return err
+					}
+					if err := tx.PutTask("b", Task{Title: "B"}); err != nil {
+						return err
+					}
+					return tx.DeleteTask("a")
+				})
+			},
+		}},
+		{"tasks from before the journal", "tasks:\n  old:\n    title: Old\n  gone:\n    title: Gone\n", []func(s Storage) error{
+			put("new", Task{Title: "New"}),
+			remove("gone"),
+		}},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "journal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "tasks.yaml")
+		if err := ioutil.WriteFile(file, []byte("version: 5\n"+test.existing), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		fs := &fileStorage{file: file, codec: yamlCodec{}}
+		js := newJournalStorage(fs, file, "test")
+		for _, change := range test.changes {
+			if err := change(js); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+
+		events, err := (&Journal{file: journalFile(file)}).Events()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		conf, err := fs.Load()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := replay(events).Tasks; !reflect.DeepEqual(got, conf.Tasks) {
+			t.Errorf("%s: replay = %v, file has %v", test.name, got, conf.Tasks)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The task file is protected by a lock directory next to it. A writer
+// owns the lock by creating the directory; readers register themselves
+// with a file in a separate readers directory, so any number of them can
+// read at the same time. Writers wait for the readers to leave, readers
+// wait while a writer holds the lock. Every lock records its owner, so
+// locks left behind by crashed processes can be detected and broken.
+
+const (
+	ownerFile = "owner"
+	// An owner is written right after a lock is taken, but old versions
+	// of task never write one, and there is no process to check then. A
+	// lock without an owner is only taken for left behind once it has
+	// not changed for this long.
+	ownerlessStaleAfter = 10 * time.Minute
+	maxLockPoll         = 250 * time.Millisecond
+)
+
+var (
+	errLocked      = errors.New("the task file is locked")
+	errLockTimeout = errors.New("timed out waiting for the lock")
+)
+
+type LockOwner struct {
+	PID     int    `json:"pid"`
+	Host    string `json:"host"`
+	Started string `json:"started"`
+}
+
+func (o *LockOwner) String() string {
+	return "pid " + strconv.Itoa(o.PID) + " on " + o.Host + " since " + humanAt(o.Started)
+}
+
+func currentOwner() LockOwner {
+	host, _ := os.Hostname()
+	return LockOwner{
+		PID:     os.Getpid(),
+		Host:    host,
+		Started: time.Now().Format(time.RFC3339),
+	}
+}
+
+// stale tells whether the owner is a process on this host that no longer
+// runs. Processes on other hosts cannot be checked.
+func (o *LockOwner) stale() bool {
+	host, _ := os.Hostname()
+	return o.Host == host && o.PID != os.Getpid() && !processAlive(o.PID)
+}
+
+func readersDir(file string) string {
+	return file + ".readers"
+}
+
+func readerFile(file string) string {
+	host, _ := os.Hostname()
+	return filepath.Join(readersDir(file), host+"."+strconv.Itoa(os.Getpid()))
+}
+
+// readOwner returns the owner recorded in path, or nil when there is none
+// (yet).
+func readOwner(path string) *LockOwner {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var o LockOwner
+	if json.Unmarshal(dat, &o) != nil {
+		return nil
+	}
+	return &o
+}
+
+func writeOwner(path string) error {
+	dat, _ := json.Marshal(currentOwner())
+	return ioutil.WriteFile(path, dat, 0644)
+}
+
+// waiter keeps track of how long we have been waiting for a lock.
+type waiter struct {
+	start   time.Time
+	poll    time.Duration
+	timeout time.Duration
+	noWait  bool
+	told    bool
+}
+
+func newWaiter() *waiter {
+	return &waiter{start: time.Now(), poll: time.Millisecond, timeout: *lockTimeout, noWait: *noWait}
+}
+
+// wait sleeps a little longer every time, or fails when we may not wait
+// any longer.
+func (w *waiter) wait(owner *LockOwner) error {
+	if w.noWait || (w.timeout > 0 && time.Since(w.start) >= w.timeout) {
+		err := errLockTimeout
+		if w.noWait {
+			err = errLocked
+		}
+		if owner != nil {
+			return fmt.Errorf("%v; it is held by %s", err, owner)
+		}
+		return err
+	}
+	if !w.told {
+		if owner != nil {
+			print("Locked by " + owner.String() + "; waiting...\n")
+		} else {
+			print("Someone has a lock; waiting...\n")
+		}
+		w.told = true
+	}
+	time.Sleep(w.poll)
+	if w.poll < maxLockPoll {
+		w.poll *= 2
+	}
+	return nil
+}
+
+// breakIfStale removes the writer lock when its owner is gone. It reports
+// whether the lock was broken.
+func breakIfStale(file string) bool {
+	if _, err := os.Stat(file); err != nil {
+		return false
+	}
+	owner := readOwner(filepath.Join(file, ownerFile))
+	if owner == nil && !ownerlessStale(file) {
+		return false
+	}
+	if owner != nil && !owner.stale() {
+		return false
+	}
+
+	// Move the lock out of the way first. Between reading the owner and
+	// the rename, another waiter may have broken the stale lock and a
+	// third process taken a new one; in that case the lock we moved is
+	// not the stale one, and it goes back.
+	graveyard := file + ".stale." + strconv.Itoa(os.Getpid())
+	if os.Rename(file, graveyard) != nil {
+		return false
+	}
+	if !isStaleLock(graveyard, owner) {
+		os.Rename(graveyard, file)
+		return false
+	}
+	os.RemoveAll(graveyard)
+	if owner != nil {
+		print("Broke stale lock of " + owner.String() + "\n")
+	} else {
+		print("Broke stale lock\n")
+	}
+	return true
+}
+
+// isStaleLock tells whether the lock directory at path is still the one
+// owned by the stale owner, or still an old ownerless one.
+func isStaleLock(path string, owner *LockOwner) bool {
+	current := readOwner(filepath.Join(path, ownerFile))
+	if owner == nil || current == nil {
+		return owner == nil && current == nil && ownerlessStale(path)
+	}
+	return *current == *owner
+}
+
+// ownerlessStale tells whether the lock at path, which has no owner, has
+// been left alone long enough to be taken for left behind.
+func ownerlessStale(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) >= ownerlessStaleAfter
+}
+
+// Lock takes the exclusive lock, for commands that change tasks.
+func Lock(file string) error {
+	w := newWaiter()
+	for {
+		err := os.Mkdir(file, 0700)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if breakIfStale(file) {
+			continue
+		}
+		if err := w.wait(readOwner(filepath.Join(file, ownerFile))); err != nil {
+			return err
+		}
+	}
+	if err := writeOwner(filepath.Join(file, ownerFile)); err != nil {
+		Unlock(file)
+		return err
+	}
+
+	// New readers back off now; wait for the current ones to finish.
+	for {
+		owner, ok := activeReader(file)
+		if !ok {
+			return nil
+		}
+		if err := w.wait(owner); err != nil {
+			Unlock(file)
+			return err
+		}
+	}
+}
+
+// activeReader returns one of the readers that still hold a shared lock,
+// cleaning up the ones that are gone.
+func activeReader(file string) (*LockOwner, bool) {
+	entries, err := ioutil.ReadDir(readersDir(file))
+	if err != nil {
+		return nil, false
+	}
+	for _, entry := range entries {
+		path := filepath.Join(readersDir(file), entry.Name())
+		owner := readOwner(path)
+		if (owner != nil && owner.stale()) || (owner == nil && ownerlessStale(path)) {
+			os.Remove(path)
+			continue
+		}
+		return owner, true
+	}
+	return nil, false
+}
+
+func Unlock(file string) error {
+	os.Remove(filepath.Join(file, ownerFile))
+	return os.Remove(file)
+}
+
+// RLock takes a shared lock, for commands that only read tasks.
+func RLock(file string) error {
+	w := newWaiter()
+	for {
+		if err := os.MkdirAll(readersDir(file), 0755); err != nil {
+			return err
+		}
+		// Announce ourselves before looking for a writer; a writer does
+		// it the other way around, so one of us always sees the other.
+		if err := writeOwner(readerFile(file)); err != nil {
+			// The readers directory may just have been removed by the
+			// last reader leaving.
+			if _, serr := os.Stat(readersDir(file)); serr == nil {
+				os.Remove(readersDir(file))
+				return err
+			}
+			continue
+		}
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return nil
+		}
+		os.Remove(readerFile(file))
+		if breakIfStale(file) {
+			continue
+		}
+		if err := w.wait(readOwner(filepath.Join(file, ownerFile))); err != nil {
+			// Do not leave the readers directory behind if we were the
+			// only one.
+			os.Remove(readersDir(file))
+			return err
+		}
+	}
+}
+
+func RUnlock(file string) error {
+	err := os.Remove(readerFile(file))
+	// Only succeeds for the last reader.
+	os.Remove(readersDir(file))
+	return err
+}
@@ -0,0 +1,116 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// deadPID returns the pid of a process that has already exited.
+func deadPID(t *testing.T) int {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+// writeLockFile writes owner to path, or leaves path empty when there is
+// none, and dates it at.
+func writeLockFile(t *testing.T, path string, owner *LockOwner, at time.Time) {
+	var dat []byte
+	if owner != nil {
+		dat, _ = json.Marshal(owner)
+	}
+	if err := ioutil.WriteFile(path, dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockContention(t *testing.T) {
+	defer func(v bool) { *noWait = v }(*noWait)
+	*noWait = true
+
+	host, _ := os.Hostname()
+	live := &LockOwner{PID: os.Getpid(), Host: host}
+	dead := &LockOwner{PID: deadPID(t), Host: host}
+	elsewhere := &LockOwner{PID: dead.PID, Host: host + ".elsewhere"}
+	now := time.Now()
+	old := now.Add(-2 * ownerlessStaleAfter)
+
+	writer := func(owner *LockOwner, at time.Time) func(t *testing.T, lock string) {
+		return func(t *testing.T, lock string) {
+			if err := os.Mkdir(lock, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if owner != nil {
+				writeLockFile(t, filepath.Join(lock, ownerFile), owner, at)
+			}
+			if err := os.Chtimes(lock, at, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	reader := func(owner *LockOwner, at time.Time) func(t *testing.T, lock string) {
+		return func(t *testing.T, lock string) {
+			if err := os.Mkdir(readersDir(lock), 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeLockFile(t, filepath.Join(readersDir(lock), "other.1"), owner, at)
+		}
+	}
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, lock string)
+		lock  bool
+		rlock bool
+	}{
+		{"free", func(t *testing.T, lock string) {}, true, true},
+		{"live writer", writer(live, now), false, false},
+		{"dead writer", writer(dead, now), true, true},
+		{"writer on another host", writer(elsewhere, old), false, false},
+		{"new writer without owner", writer(nil, now), false, false},
+		{"old writer without owner", writer(nil, old), true, true},
+		{"live reader", reader(live, now), false, true},
+		{"dead reader", reader(dead, now), true, true},
+		{"new reader without owner", reader(nil, now), false, true},
+		{"old reader without owner", reader(nil, old), true, true},
+	}
+	for _, test := range tests {
+		for _, shared := range []bool{false, true} {
+			dir, err := ioutil.TempDir("", "lock")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			lock := filepath.Join(dir, "tasks.yaml.lock")
+			test.setup(t, lock)
+			_, hadReaders := os.Stat(readersDir(lock))
+
+			lockFn, unlockFn, want := Lock, Unlock, test.lock
+			if shared {
+				lockFn, unlockFn, want = RLock, RUnlock, test.rlock
+			}
+			err = lockFn(lock)
+			if (err == nil) != want {
+				t.Errorf("%s: shared %v: error %v", test.name, shared, err)
+			}
+			if err == nil {
+				unlockFn(lock)
+			}
+			if _, err := os.Stat(readersDir(lock)); hadReaders != nil && err == nil {
+				t.Errorf("%s: shared %v: left the readers directory behind", test.name, shared)
+			}
+		}
+	}
+}
@@ -2,120 +2,422 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/olekukonko/tablewriter"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
-	"gopkg.in/yaml.v2"
 )
 
 var (
 	app             = kingpin.New("Task", "Task management").DefaultEnvars()
-	file            = app.Flag("file", "Filename of the tasks.").Required().String()
+	file            = app.Flag("file", "Filename of the tasks.").String()
 	showDone        = app.Flag("show-done", "Show tasks marked as done.").Short('d').Bool()
-	filterFields    = app.Flag("filter", "Filter by field=value").Strings()
+	filterFields    = app.Flag("filter", "Filter by field=value, field!=value, field<value etc., +tag or -tag (write --filter=-tag)").Strings()
+	sortKeys        = app.Flag("sort", "Sort by name, title, state, assignee, due, created, updated or a custom field; --sort=-key sorts descending").Strings()
+	onlyBlocked     = app.Flag("blocked", "Only show tasks waiting for other tasks").Bool()
+	onlyUnblocked   = app.Flag("unblocked", "Only show tasks not waiting for other tasks").Bool()
+	onlyOverdue     = app.Flag("overdue", "Only show tasks past their due date").Bool()
+	dueBeforeFlag   = app.Flag("due-before", "Only show tasks due before this date").String()
+	dueWithinFlag   = app.Flag("due-within", "Only show tasks due within this span, e.g. 7d; includes overdue tasks").String()
 	showFields      = app.Flag("field", "Extra field to show").Strings()
-	exportFormat    = app.Flag("format", "Output format").Short('f').Default("table").Enum("table", "json")
+	showLogged      = app.Flag("logged", "Show the time logged on the tasks").Bool()
+	exportFormat    = app.Flag("format", "Output format; csv only for timesheet").Short('f').Default("table").Enum("table", "json", "csv")
+	backend         = app.Flag("backend", "Storage backend; 'auto' picks one from the file extension").Default("auto").Enum("auto", "yaml", "json", "bolt", "dir")
+	lockTimeout     = app.Flag("lock-timeout", "Give up waiting for the lock after this long; 0 waits forever").Default("0").Duration()
+	noWait          = app.Flag("no-wait", "Fail right away when someone else holds the lock").Bool()
+	ifRevision      = app.Flag("if-revision", "Only change the task if it is still at this revision; 0 means it must not exist yet").Default("-1").Int()
+	backups         = app.Flag("backups", "Number of previous versions of the task file to keep").Default("3").Int()
 	initFile        = app.Command("init", "Initialize the task file")
 	stats           = app.Command("stats", "Show a bunch of statistics about the tasks")
 	show            = app.Command("show", "Show tasks")
 	showName        = show.Arg("name", "Task name").String()
+	history         = app.Command("history", "Show all changes of a task")
+	historyName     = history.Arg("name", "Task name").Required().String()
+	next            = app.Command("next", "Suggest tasks to work on next")
+	nextFor         = next.Flag("for", "Suggest tasks for this user; 'me' is you").Default("me").String()
+	graph           = app.Command("graph", "Show the dependencies between tasks as a graph")
+	graphFormat     = graph.Flag("type", "Graph language").Default("dot").Enum("dot", "mermaid")
+	tree            = app.Command("tree", "Show tasks with their subtasks")
+	treeName        = tree.Arg("name", "Only show this task and its subtasks").String()
+	critical        = app.Command("critical-path", "Show the critical path and slack of the open tasks, using their remaining work")
+	burndownCmd     = app.Command("burndown", "Show the remaining work per day, from the journal")
+	burndownSince   = burndownCmd.Flag("since", "First day; two weeks ago by default").String()
 	search          = app.Command("search", "Search for tasks").Alias("find")
 	searchName      = search.Arg("string", "Part of task name or title").String()
 	create          = app.Command("create", "Create task")
 	createName      = create.Arg("name", "Task name").Required().String()
 	createTitle     = create.Arg("title", "Task title").Required().Strings()
+	createParent    = create.Flag("parent", "Make the task a subtask of this task").String()
+	createFields    = create.Flag("set", "Set a custom field, as field=value").Strings()
 	deleteT         = app.Command("delete", "Delete task")
 	deleteTName     = deleteT.Arg("name", "Task name").Required().String()
+	deleteRecursive = deleteT.Flag("recursive", "Also delete all subtasks").Short('r').Bool()
 	setState        = app.Command("set-state", "Set task state")
 	setStateName    = setState.Arg("name", "Task name").Required().String()
-	setStateState   = setState.Arg("state", "State").Required().Enum("todo", "in-progress", "done")
-	assign          = app.Command("assign", "Set task assignee")
+	setStateState   = setState.Arg("state", "State, as defined by the workflow").Required().String()
+	setStateComment = setState.Flag("comment", "Comment on the change").String()
+	workflow        = app.Command("workflow", "Show the states a task can be in")
+	setWorkflowCmd  = app.Command("set-workflow", "Define the states a task can be in")
+	workflowStates  = setWorkflowCmd.Flag("state", "A state, in order; the first one is where new tasks start").Required().Strings()
+	workflowClosed  = setWorkflowCmd.Flag("closed", "A state that counts as done").Strings()
+	workflowMoves   = setWorkflowCmd.Flag("transition", "Allowed changes as from:to,to; without any, every change is allowed").Strings()
+	workflowNeeds   = setWorkflowCmd.Flag("require", "Requirements to move into a state as state:requirement,...; comment, assignee, due or field:<name>").Strings()
+	assign          = app.Command("assign", "Set task assignees")
 	assignName      = assign.Arg("name", "Task name").Required().String()
-	assignAssignee  = assign.Arg("state", "Assignee - you can use 'me', 'none' or empty (= 'me')").String()
+	assignUsers     = assign.Arg("users", "Assignees - you can use 'me', 'none' or nothing (= 'me')").Strings()
+	assignAdd       = assign.Flag("add", "Add to the assignees instead of replacing them").Bool()
+	assignRemove    = assign.Flag("remove", "Remove from the assignees").Bool()
+	watch           = app.Command("watch", "Watch a task")
+	watchName       = watch.Arg("name", "Task name").Required().String()
+	watchUsers      = watch.Arg("users", "Watchers - you can use 'me' or nothing (= 'me')").Strings()
+	unwatch         = app.Command("unwatch", "Stop watching a task")
+	unwatchName     = unwatch.Arg("name", "Task name").Required().String()
+	unwatchUsers    = unwatch.Arg("users", "Watchers - you can use 'me' or nothing (= 'me')").Strings()
 	comment         = app.Command("comment", "Add a comment")
 	commentName     = comment.Arg("name", "Task name").Required().String()
-	commentComment  = comment.Arg("the comment", "The comment").Required().Strings()
+	commentComment  = comment.Arg("the comment", "The comment; '-' reads it from standard input").Strings()
+	commentEditor   = comment.Flag("edit", "Write the comment in $EDITOR").Short('e').Bool()
+	commentEdit     = app.Command("comment-edit", "Change one of your comments")
+	commentEditName = commentEdit.Arg("name", "Task name").Required().String()
+	commentEditID   = commentEdit.Arg("comment-id", "Comment ID, or the start of it").Required().String()
+	commentEditText = commentEdit.Arg("the comment", "The new comment").Required().Strings()
+	commentDelete   = app.Command("comment-delete", "Delete one of your comments")
+	commentDelName  = commentDelete.Arg("name", "Task name").Required().String()
+	commentDelID    = commentDelete.Arg("comment-id", "Comment ID, or the start of it").Required().String()
+	reply           = app.Command("reply", "Reply to a comment")
+	replyName       = reply.Arg("name", "Task name").Required().String()
+	replyID         = reply.Arg("comment-id", "Comment ID, or the start of it").Required().String()
+	replyComment    = reply.Arg("the comment", "The reply").Required().Strings()
 	setField        = app.Command("set", "Set a custom field")
 	setFieldName    = setField.Arg("name", "Task name").Required().String()
 	setFieldFName   = setField.Arg("field-name", "Field name").Required().String()
 	setFieldFValue  = setField.Arg("field value", "Field name").Required().Strings()
+	depend          = app.Command("depend", "Make a task wait for other tasks")
+	dependName      = depend.Arg("name", "Task name").Required().String()
+	dependOn        = depend.Arg("after", "Tasks to finish first").Required().Strings()
+	setParent       = app.Command("set-parent", "Make a task a subtask of another task")
+	setParentName   = setParent.Arg("name", "Task name").Required().String()
+	setParentParent = setParent.Arg("parent", "Parent task - 'none' or empty makes it a top-level task").String()
+	due             = app.Command("due", "Set the due date of a task")
+	dueName         = due.Arg("name", "Task name").Required().String()
+	dueWhen         = due.Arg("when", "Date or time, e.g. 2026-11-01, tomorrow, fri, +3d or end of month; 'none' or empty removes it").Strings()
+	recur           = app.Command("recur", "Make a task repeat when it is done")
+	recurName       = recur.Arg("name", "Task name").Required().String()
+	recurRule       = recur.Arg("rule", "daily, weekly, monthly, yearly, 'every 2w', 'after 3d' or a cron expression; 'none' or empty stops it").Strings()
+	tag             = app.Command("tag", "Add tags to a task")
+	tagName         = tag.Arg("name", "Task name").Required().String()
+	tagTags         = tag.Arg("tags", "Tags to add").Required().Strings()
+	untag           = app.Command("untag", "Remove tags from a task")
+	untagName       = untag.Arg("name", "Task name").Required().String()
+	untagTags       = untag.Arg("tags", "Tags to remove").Required().Strings()
+	tags            = app.Command("tags", "List all tags with the number of tasks")
+	schema          = app.Command("schema", "Show the declared custom fields")
+	define          = app.Command("define", "Declare a custom field in the schema")
+	defineField     = define.Arg("field", "Field name").Required().String()
+	defineType      = define.Arg("type", "Field type").Required().Enum(fieldTypes...)
+	defineValues    = define.Flag("values", "Allowed values of an enum field, in order").Strings()
+	defineDefault   = define.Flag("default", "Value for new tasks").String()
+	defineRequired  = define.Flag("required", "Every new task must have a value").Bool()
+	undefine        = app.Command("undefine", "Remove a custom field from the schema")
+	undefineField   = undefine.Arg("field", "Field name").Required().String()
+	start           = app.Command("start", "Start working on a task")
+	startName       = start.Arg("name", "Task name").Required().String()
+	startClaim      = start.Flag("claim", "Also assign the task to you and move it to in-progress").Bool()
+	stop            = app.Command("stop", "Stop working on a task")
+	stopName        = stop.Arg("name", "Task name; the one you are working on if empty").String()
+	logTime         = app.Command("log", "Log time worked on a task")
+	logName         = logTime.Arg("name", "Task name").Required().String()
+	logDuration     = logTime.Arg("duration", "Time worked, e.g. 1h30m").Required().String()
+	logNote         = logTime.Arg("note", "What was done").Strings()
+	timesheetCmd    = app.Command("timesheet", "Show the time worked")
+	timesheetFrom   = timesheetCmd.Flag("from", "Start of the period; the last seven days by default").String()
+	timesheetTo     = timesheetCmd.Flag("to", "End of the period; now by default").String()
+	timesheetUser   = timesheetCmd.Flag("user", "Only this user; 'me' is you").String()
+	estimate        = app.Command("estimate", "Set the estimated work of a task")
+	estimateName    = estimate.Arg("name", "Task name").Required().String()
+	estimateAmount  = estimate.Arg("amount", "Amount of work, in any unit as long as it is always the same").Required().String()
+	remaining       = app.Command("remaining", "Set the work left on a task")
+	remainingName   = remaining.Arg("name", "Task name").Required().String()
+	remainingAmount = remaining.Arg("amount", "Amount of work; 'none' goes back to the estimate").Required().String()
+	undepend        = app.Command("undepend", "Stop a task from waiting for other tasks")
+	undependName    = undepend.Arg("name", "Task name").Required().String()
+	undependOn      = undepend.Arg("after", "Tasks to no longer wait for").Required().Strings()
 	unsetField      = app.Command("unset", "Set a custom field")
 	unsetFieldName  = unsetField.Arg("name", "Task name").Required().String()
 	unsetFieldFName = unsetField.Arg("field-name", "Field name").Required().String()
+	restore         = app.Command("restore-backup", "Restore a previous version of the task file")
+	restoreNumber   = restore.Arg("number", "Backup number; 1 is the most recent").Default("1").Int()
+	convert         = app.Command("convert", "Copy all tasks to another file or directory layout")
+	convertTarget   = convert.Arg("target", "Target file, or directory for one file per task").Required().String()
+	convertBackend  = convert.Flag("target-backend", "Storage backend of the target").Default("auto").Enum("auto", "yaml", "json", "bolt", "dir")
+	undo            = app.Command("undo", "Revert your most recent changes")
+	undoCount       = undo.Arg("n", "Number of changes to revert").Default("1").Int()
+	redo            = app.Command("redo", "Re-apply your most recently reverted change")
+	migrate         = app.Command("migrate", "Upgrade the task file to the current format version")
+	migrateDryRun   = migrate.Flag("dry-run", "Only show the migrations that would run").Bool()
+	rebuild         = app.Command("rebuild", "Rebuild the task file by replaying the journal")
+	mergeDrv        = app.Command("merge-driver", "Three-way merge of task files, for use as a git merge driver")
+	mergeBase       = mergeDrv.Arg("base", "Common ancestor (%O)").Required().String()
+	mergeOurs       = mergeDrv.Arg("ours", "Our version, overwritten with the result (%A)").Required().String()
+	mergeTheirs     = mergeDrv.Arg("theirs", "Their version (%B)").Required().String()
 
 	lockfile string
-	filters  = map[string]string{}
+	filters  []fieldFilter
+
+	// readOnlyCommands only need a shared lock, so they do not block
+	// each other.
+	readOnlyCommands = map[string]bool{
+		"show":          true,
+		"search":        true,
+		"stats":         true,
+		"history":       true,
+		"next":          true,
+		"graph":         true,
+		"tree":          true,
+		"tags":          true,
+		"schema":        true,
+		"workflow":      true,
+		"timesheet":     true,
+		"burndown":      true,
+		"critical-path": true,
+	}
 )
 
+// exitRevisionMismatch is the exit code when --if-revision does not match,
+// so scripts can tell a lost race from other failures.
+const exitRevisionMismatch = 3
+
+// exitStatus is set by commands that refuse what they were asked to do;
+// main exits with it once the lock is released.
+var exitStatus = 0
+
 func main() {
 	var conf TaskConfig
+	var store Storage
 	var err error
 	var command string
 
-	command = kingpin.MustParse(app.Parse(os.Args[1:]))
-	lockfile = *file + ".lock"
+	// Registered first, so it runs after the deferred unlock.
+	defer exitOnRevisionMismatch()
+
+	command = kingpin.MustParse(app.Parse(stdinArg(os.Args[1:])))
+
+	// The merge driver works on the files git hands it, not on --file.
+	if command == "merge-driver" {
+		os.Exit(mergeDriver(*mergeBase, *mergeOurs, *mergeTheirs))
+	}
+	if *file == "" {
+		app.Fatalf("required flag --file not provided, try --help")
+	}
+	if *exportFormat == "csv" && command != "timesheet" {
+		app.Fatalf("--format csv is only supported by timesheet")
+	}
+	if err = parseDueFilters(time.Now()); err != nil {
+		app.Fatalf("%s", err)
+	}
+	lockfile = filepath.Clean(*file) + ".lock"
+
+	// Writing a comment in an editor can take a while, so it is done
+	// before taking the lock.
+	var commentText string
+	if command == "comment" {
+		if commentText, err = readComment(*commentName, *commentComment, *commentEditor); err != nil {
+			app.Fatalf("%s", err)
+		}
+	}
 
-	err = Lock(lockfile)
+	unlock := Unlock
+	if readOnlyCommands[command] {
+		err = RLock(lockfile)
+		unlock = RUnlock
+	} else {
+		err = Lock(lockfile)
+	}
 	if err != nil {
-		panic(err)
+		app.Fatalf("%s", err)
 	}
-	defer Unlock(lockfile)
+	defer unlock(lockfile)
 
 	if command == "init" {
-		initTaskFile(*file)
+		initTaskFile(*file, *backend)
 	}
 
-	if conf, err = readTasks(*file); err != nil {
-		panic(err)
+	if command == "restore-backup" {
+		restoreBackup(*file, *backend, *restoreNumber)
+		return
+	}
+
+	if store, err = openStorage(*file, *backend, readOnlyCommands[command]); err != nil {
+		// Fatalf exits right away, without running the deferred unlock.
+		unlock(lockfile)
+		app.Fatalf("%s", err)
 	}
+	defer store.Close()
+
+	if command == "migrate" {
+		migrateTasks(store, *migrateDryRun)
+		return
+	}
+	if command == "rebuild" {
+		rebuildTasks(store, *file)
+		return
+	}
+	journaled := newJournalStorage(store, *file, command)
+	store = journaled
+	activeWorkflow = loadWorkflow(store)
 
 	for _, ff := range *filterFields {
-		split := strings.SplitN(ff, "=", 2)
-		if len(split) == 2 {
-			filters[split[0]] = split[1]
+		if parseTagFilter(ff) {
+			continue
+		}
+		if f, ok := parseFieldFilter(ff); ok {
+			filters = append(filters, f)
 		}
 	}
+	if len(filters) > 0 || len(*sortKeys) > 0 {
+		fieldSchema = loadSchema(store)
+	}
 
 	switch command {
 	case "init":
 	case "show":
 		if *showName == "" {
+			if conf, err = store.Load(); err != nil {
+				panic(err)
+			}
 			showTasks(&conf)
 		} else {
-			showTask(*showName, conf.Tasks[*showName])
-			showTaskComments(*showName, conf.Tasks[*showName])
+			task, _, err := store.GetTask(*showName)
+			if err != nil {
+				panic(err)
+			}
+			showTaskTable(store, *showName, task, true)
+			showTaskComments(*showName, task)
 		}
 	case "stats":
+		if conf, err = store.Load(); err != nil {
+			panic(err)
+		}
 		showStats(&conf)
+	case "next":
+		if conf, err = store.Load(); err != nil {
+			panic(err)
+		}
+		showNext(&conf, *nextFor)
+	case "graph":
+		if conf, err = store.Load(); err != nil {
+			panic(err)
+		}
+		showGraph(&conf, *graphFormat)
+	case "tags":
+		if conf, err = store.Load(); err != nil {
+			panic(err)
+		}
+		showTags(&conf)
+	case "burndown":
+		showBurndown(*file, *burndownSince)
+	case "estimate":
+		setTaskEstimate(store, *estimateName, *estimateAmount)
+	case "remaining":
+		setTaskRemaining(store, *remainingName, *remainingAmount)
+	case "timesheet":
+		if conf, err = store.Load(); err != nil {
+			panic(err)
+		}
+		showTimesheet(&conf, *timesheetFrom, *timesheetTo, *timesheetUser)
+	case "start":
+		startTimer(store, *startName, *startClaim)
+	case "stop":
+		stopTimer(store, *stopName)
+	case "log":
+		logWork(store, *logName, *logDuration, *logNote)
+	case "workflow":
+		showWorkflow(activeWorkflow)
+	case "set-workflow":
+		w, err := parseWorkflowFlags(*workflowStates, *workflowClosed, *workflowMoves, *workflowNeeds)
+		if err != nil {
+			print(err.Error() + "\n")
+			exitStatus = 1
+			break
+		}
+		setWorkflow(store, w)
+	case "schema":
+		showSchema(loadSchema(store))
+	case "define":
+		defineSchemaField(store, *defineField, FieldSchema{Type: *defineType, Values: *defineValues, Default: *defineDefault, Required: *defineRequired})
+	case "undefine":
+		undefineSchemaField(store, *undefineField)
+	case "tree":
+		if conf, err = store.Load(); err != nil {
+			panic(err)
+		}
+		showTree(&conf, *treeName)
+	case "critical-path":
+		if conf, err = store.Load(); err != nil {
+			panic(err)
+		}
+		showCriticalPath(&conf)
 	case "search":
-		searchTasks(*file, *searchName)
+		searchTasks(store, *searchName)
+	case "history":
+		showHistory(*file, *historyName)
 	case "create":
-		createTask(*file, *createName, *createTitle)
+		createTask(store, *createName, *createTitle, *createParent, *createFields)
 	case "delete":
-		deleteTask(*file, *deleteTName)
+		deleteTask(store, *deleteTName, *deleteRecursive)
 	case "set-state":
-		setTaskState(*file, *setStateName, *setStateState)
+		setTaskState(store, *setStateName, *setStateState, *setStateComment)
 	case "assign":
-		setTaskAssignee(*file, *assignName, *assignAssignee)
+		assignTask(store, *assignName, *assignUsers, *assignAdd, *assignRemove)
+	case "watch":
+		watchTask(store, *watchName, *watchUsers)
+	case "unwatch":
+		unwatchTask(store, *unwatchName, *unwatchUsers)
 	case "comment":
-		addTaskComment(*file, *commentName, *commentComment)
+		addTaskComment(store, *commentName, commentText)
+	case "comment-edit":
+		editTaskComment(store, *commentEditName, *commentEditID, *commentEditText)
+	case "comment-delete":
+		deleteTaskComment(store, *commentDelName, *commentDelID)
+	case "reply":
+		replyTaskComment(store, *replyName, *replyID, *replyComment)
 	case "set":
-		setTaskField(*file, *setFieldName, *setFieldFName, *setFieldFValue)
+		setTaskField(store, *setFieldName, *setFieldFName, *setFieldFValue)
 	case "unset":
-		unsetTaskField(*file, *unsetFieldName, *unsetFieldFName)
+		unsetTaskField(store, *unsetFieldName, *unsetFieldFName)
+	case "depend":
+		dependTask(store, *dependName, *dependOn)
+	case "undepend":
+		undependTask(store, *undependName, *undependOn)
+	case "due":
+		setTaskDue(store, *dueName, *dueWhen)
+	case "recur":
+		setTaskRecurrence(store, *recurName, *recurRule)
+	case "tag":
+		tagTask(store, *tagName, *tagTags)
+	case "untag":
+		untagTask(store, *untagName, *untagTags)
+	case "set-parent":
+		setTaskParent(store, *setParentName, *setParentParent)
+	case "undo":
+		undoMutations(journaled, *undoCount)
+	case "redo":
+		redoMutation(journaled)
+	case "convert":
+		convertTasks(store, *convertTarget, *convertBackend)
 	default:
 		panic("Unknown command: " + command)
 	}
 }
 
 func showTasks(conf *TaskConfig) {
-	showSomeTasks(&conf.Tasks)
+	showSomeTasks(conf, &conf.Tasks)
 }
 
 func parseUser(user string) string {
@@ -132,38 +434,65 @@ func parseUser(user string) string {
 	}
 }
 
-func showSomeTasks(tasks *map[string]Task) {
+// showSomeTasks shows tasks, a selection of all tasks in conf.
+func showSomeTasks(conf *TaskConfig, tasks *map[string]Task) {
+	// tasks may be conf.Tasks itself, which is filtered below.
+	all := map[string]Task{}
+	for name, task := range conf.Tasks {
+		all[name] = task
+	}
+	lookup := mapLookup(all)
 	for name, task := range *tasks {
-		if !*showDone && task.State == "done" {
+		if !*showDone && task.IsDone() {
 			delete(*tasks, name)
 		}
-		for k, v := range filters {
-			if task.GetField(k) != v {
-				delete(*tasks, name)
-			}
+		blocked := len(blockers(lookup, task)) > 0
+		if *onlyBlocked && !blocked || *onlyUnblocked && blocked {
+			delete(*tasks, name)
+		}
+		if !matchesFilters(task) {
+			delete(*tasks, name)
 		}
 	}
 	switch *exportFormat {
 	case "table":
-		showSomeTasksTable(tasks)
+		showSomeTasksTable(lookup, tasks)
 	case "json":
 		showSomeTasksJson(tasks)
 	}
 }
 
+func matchesFilters(task Task) bool {
+	for _, f := range filters {
+		if !f.matches(task) {
+			return false
+		}
+	}
+	return matchesTagFilters(task) && matchesDueFilters(task, time.Now())
+}
+
 func showSomeTasksJson(tasks *map[string]Task) {
 	res, _ := json.Marshal(tasks)
 	fmt.Println(string(res))
 }
 
-func showSomeTasksTable(tasks *map[string]Task) {
+func showSomeTasksTable(lookup taskLookup, tasks *map[string]Task) {
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetColWidth(100)
-	headers := append([]string{"Name", "Title", "State", "Assignee", "Comments"}, *showFields...)
+	headers := []string{"Name", "Title", "State", "Assignees", "Tags", "Due", "Comments", "Blocked by"}
+	if *showLogged {
+		headers = append(headers, "Logged")
+	}
+	headers = append(headers, *showFields...)
 
 	table.SetHeader(headers)
-	for key, v := range *tasks {
-		fields := []string{key, v.Title, v.State, v.Assignee, strconv.Itoa(len(v.Comments))}
+	now := time.Now()
+	for _, key := range sortTaskNames(*tasks, *sortKeys) {
+		v := (*tasks)[key]
+		fields := []string{key, v.Title, v.State, joinPeople(v.Assignees), strings.Join(v.Tags, ", "), dueCell(v, now), strconv.Itoa(v.CommentCount()), strings.Join(blockers(lookup, v), ", ")}
+		if *showLogged {
+			fields = append(fields, formatWorked(v.Logged(now)))
+		}
 		for _, f := range *showFields {
 			fields = append(fields, v.GetField(f))
 		}
@@ -172,60 +501,124 @@ func showSomeTasksTable(tasks *map[string]Task) {
 	table.Render()
 }
 
-func showTask(name string, task Task) {
+func showTask(s Storage, name string, task Task) {
+	showTaskTable(s, name, task, false)
+}
+
+// showTaskTable shows a task; counting its subtasks means going through
+// all tasks, so that is only done when asked for.
+func showTaskTable(s Storage, name string, task Task, withSubtasks bool) {
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetColWidth(100)
 	table.SetAlignment(tablewriter.ALIGN_LEFT) // Set Alignment
 	table.SetHeader([]string{"", "Showing task '" + name + "'"})
 	table.Append([]string{"Title", task.Title})
-	table.Append([]string{"Assignee", task.Assignee})
+	table.Append([]string{"Assignees", joinPeople(task.Assignees)})
+	if len(task.Watchers) > 0 {
+		table.Append([]string{"Watchers", joinPeople(task.Watchers)})
+	}
 	table.Append([]string{"State", task.State})
-	table.Append([]string{"Comments", strconv.Itoa(len(task.Comments))})
+	if len(task.Tags) > 0 {
+		table.Append([]string{"Tags", strings.Join(task.Tags, ", ")})
+	}
+	if task.Due != "" {
+		table.Append([]string{"Due", dueCell(task, time.Now())})
+	}
+	if task.Recur != "" {
+		table.Append([]string{"Recurs", task.Recur})
+	}
+	if task.Previous != "" {
+		table.Append([]string{"Previous", task.Previous})
+	}
+	if task.Parent != "" {
+		table.Append([]string{"Parent", task.Parent})
+	}
+	if withSubtasks {
+		if done, total, err := subtaskProgress(s, name); err == nil && total > 0 {
+			table.Append([]string{"Subtasks", strconv.Itoa(done) + " of " + strconv.Itoa(total) + " done"})
+		}
+	}
+	if len(task.AfterTasks) > 0 {
+		table.Append([]string{"After", strings.Join(task.AfterTasks, ", ")})
+		after, err := getTasks(s, task.AfterTasks)
+		if err != nil {
+			panic(err)
+		}
+		if blocked := blockers(mapLookup(after), task); len(blocked) > 0 {
+			table.Append([]string{"Blocked by", strings.Join(blocked, ", ")})
+		}
+	}
+	if task.Estimate != 0 || task.Remaining != nil {
+		table.Append([]string{"Estimate", formatAmount(task.Estimate)})
+		table.Append([]string{"Remaining", formatAmount(task.RemainingWork())})
+	}
+	table.Append([]string{"Comments", strconv.Itoa(task.CommentCount())})
+	if len(task.Worklog) > 0 {
+		table.Append([]string{"Logged", formatWorked(task.Logged(time.Now()))})
+		for _, w := range task.Worklog {
+			if w.Running() {
+				table.Append([]string{"Working", w.User + " since " + humanAt(w.Start)})
+			}
+		}
+	}
 	table.Append([]string{"Created at", task.HumanCreatedAt()})
 	table.Append([]string{"Updated at", task.HumanUpdatedAt()})
+	table.Append([]string{"Revision", strconv.Itoa(task.Revision)})
 	for key, _ := range task.Fields {
 		table.Append([]string{key, task.GetField(key)})
 	}
 	table.Render()
 }
 
-func showTaskComments(name string, task Task) {
-	if len(task.Comments) > 0 {
-		comments := tablewriter.NewWriter(os.Stdout)
-		comments.SetColWidth(100)
-		comments.SetHeader([]string{"", "Comments for task '" + name + "'", ""})
-		for _, comment := range task.Comments {
-			comments.Append([]string{comment.By, comment.Comment, comment.HumanAt()})
+func showStats(conf *TaskConfig) {
+	// Sums of work are only shown when there are estimates at all.
+	withWork := false
+	for _, task := range conf.Tasks {
+		withWork = withWork || task.Estimate != 0 || task.Remaining != nil
+	}
+	groupPrint := func(title string, match func(task Task) bool, key func(task Task) string) {
+		results := map[string]int{}
+		var work map[string]workSum
+		if withWork {
+			work = map[string]workSum{}
+		}
+		for _, task := range conf.Tasks {
+			if !match(task) {
+				continue
+			}
+			k := key(task)
+			results[k] = results[k] + 1
+			if work != nil {
+				work[k] = work[k].add(task)
+			}
 		}
-		comments.Render()
+		sortPrint(title, results, work)
+	}
+	all := func(task Task) bool { return true }
+	// Tasks without a state are in the initial one, as everywhere else.
+	state := func(task Task) string {
+		if task.State == "" {
+			return activeWorkflow.initialState()
+		}
+		return task.State
 	}
-}
 
-func showStats(conf *TaskConfig) {
-	results := map[string]int{}
-	var key string
-	for _, task := range conf.Tasks {
-		key = task.State
-		if key == "" {
-			key = "(unset)"
+	groupPrint("State", all, state)
+	groupPrint("Closed", all, func(task Task) string {
+		if task.IsDone() {
+			return "closed"
 		}
-		results[key] = results[key] + 1
+		return "open"
+	})
+	for _, tag := range allTags(conf.Tasks) {
+		tag := tag
+		groupPrint("+"+tag, func(task Task) bool { return task.HasTag(tag) }, state)
 	}
-	sortPrint("State", results)
 	for _, field := range *showFields {
 		values := allValuesForField(&conf.Tasks, field)
 		for _, value := range values {
-			results := map[string]int{}
-			for _, task := range conf.Tasks {
-				if task.GetField(field) == value {
-					key = task.State
-					if key == "" {
-						key = "(unset)"
-					}
-					results[key] = results[key] + 1
-				}
-			}
-			sortPrint(field+"="+value, results)
+			field, value := field, value
+			groupPrint(field+"="+value, func(task Task) bool { return task.GetField(field) == value }, state)
 		}
 	}
 }
@@ -245,20 +638,39 @@ func allValuesForField(tasks *map[string]Task, field string) []string {
 	return result
 }
 
-func sortPrint(title string, results map[string]int) {
+// sortPrint prints the number of tasks per key and, when work is given,
+// the sums of their estimates and remaining work.
+func sortPrint(title string, results map[string]int, work map[string]workSum) {
 	total := 0
-	for _, value := range results {
+	var totalWork workSum
+	for key, value := range results {
 		total += value
+		totalWork.Estimate += work[key].Estimate
+		totalWork.Remaining += work[key].Remaining
 	}
-	print("Grouped by '" + title + "'; total: " + strconv.Itoa(total) + "\n")
-	for key, value := range results {
-		fmt.Printf("%10s: %10d/%-10d (%.2f%%)\n", key, value, total, 100*float64(value)/float64(total))
+	print("Grouped by '" + title + "'; total: " + strconv.Itoa(total))
+	if work != nil {
+		print("; estimate: " + formatAmount(totalWork.Estimate) + ", remaining: " + formatAmount(totalWork.Remaining))
+	}
+	print("\n")
+	keys := []string{}
+	for key := range results {
+		keys = append(keys, key)
+	}
+	activeWorkflow.stateOrder(keys)
+	for _, key := range keys {
+		value := results[key]
+		fmt.Printf("%10s: %10d/%-10d (%.2f%%)", key, value, total, 100*float64(value)/float64(total))
+		if work != nil {
+			fmt.Printf("  estimate: %8s  remaining: %8s", formatAmount(work[key].Estimate), formatAmount(work[key].Remaining))
+		}
+		fmt.Println()
 	}
 }
 
-func searchTasks(file string, name string) {
+func searchTasks(s Storage, name string) {
 	tasks := map[string]Task{}
-	conf, _ := readTasks(file)
+	conf, _ := s.Load()
 
 	for id, task := range conf.Tasks {
 		if strings.Contains(id, name) ||
@@ -267,169 +679,289 @@ func searchTasks(file string, name string) {
 		}
 	}
 
-	showSomeTasks(&tasks)
+	showSomeTasks(&conf, &tasks)
 }
 
-func deleteTask(file string, name string) {
-	conf, _ := readTasks(file)
-	if conf.Tasks != nil {
-		if _, ok := conf.Tasks[name]; ok {
-			delete(conf.Tasks, name)
-			print("Deleted task '" + name + "'\n")
-		} else {
-			print("No task '" + name + "' found\n")
-		}
-	} else {
-		print("No task '" + name + "' found\n")
-	}
-	writeTasks(file, &conf)
-}
-func createTask(file string, name string, titleArray []string) {
-	title := strings.Join(titleArray, " ")
-	conf, _ := readTasks(file)
-	task := Task{
-		Title: title,
-	}
-	task.Update()
-	conf.Tasks[name] = task
-	writeTasks(file, &conf)
-	showTask(name, task)
-}
-func setTaskState(file string, name string, state string) {
-	conf, _ := readTasks(file)
-	task := conf.Tasks[name]
-	task.State = state
-	task.Update()
-	conf.Tasks[name] = task
-	writeTasks(file, &conf)
-	showTask(name, task)
+type errRevisionMismatch struct {
+	name     string
+	revision int
+	expected int
 }
 
-func setTaskAssignee(file string, name string, assignee string) {
-	assignee = parseUser(assignee)
-	conf, _ := readTasks(file)
-	task := conf.Tasks[name]
-	task.Assignee = assignee
-	task.Update()
-	conf.Tasks[name] = task
-	writeTasks(file, &conf)
-	showTask(name, task)
+func (e errRevisionMismatch) Error() string {
+	return "task '" + e.name + "' is at revision " + strconv.Itoa(e.revision) + ", not " + strconv.Itoa(e.expected)
 }
 
-func addTaskComment(file string, name string, commentArray []string) {
-	comment := strings.Join(commentArray, " ")
-	user := parseUser("me")
-	commentObj := TaskComment{
-		Comment: comment,
-		By:      user,
-		At:      time.Now().Format(time.RFC3339),
-	}
-	conf, _ := readTasks(file)
-	task := conf.Tasks[name]
-	task.Comments = append(task.Comments, commentObj)
-	task.Update()
-	conf.Tasks[name] = task
-	writeTasks(file, &conf)
-	showTask(name, task)
+// checkRevision implements --if-revision for a task about to be changed.
+func checkRevision(name string, task Task) error {
+	if *ifRevision >= 0 && task.Revision != *ifRevision {
+		return errRevisionMismatch{name: name, revision: task.Revision, expected: *ifRevision}
+	}
+	return nil
 }
 
-func setTaskField(file string, name string, fieldName string, fieldValueArray []string) {
-	fieldValue := strings.Join(fieldValueArray, " ")
-	if fieldValue == "" {
-		unsetTaskField(file, name, fieldName)
-		return
-	}
-	conf, _ := readTasks(file)
-	task := conf.Tasks[name]
-	if task.Fields == nil {
-		task.Fields = map[string]string{
-			fieldName: fieldValue,
+func exitOnRevisionMismatch() {
+	if r := recover(); r != nil {
+		if err, ok := r.(errRevisionMismatch); ok {
+			print(err.Error() + "\n")
+			os.Exit(exitRevisionMismatch)
 		}
-	} else {
-		task.Fields[fieldName] = fieldValue
+		panic(r)
+	}
+	if exitStatus != 0 {
+		os.Exit(exitStatus)
 	}
-	task.Update()
-	conf.Tasks[name] = task
-	writeTasks(file, &conf)
-	showTask(name, task)
 }
 
-func unsetTaskField(file string, name string, fieldName string) {
-	conf, _ := readTasks(file)
-	task := conf.Tasks[name]
-	if task.Fields != nil {
-		if _, ok := task.Fields[fieldName]; ok {
-			delete(task.Fields, fieldName)
-			print("Deleted field '" + fieldName + "' for task '" + name + "'\n")
-			task.Update()
-			conf.Tasks[name] = task
-			writeTasks(file, &conf)
-		} else {
-			print("No field '" + fieldName + "' found for task '" + name + "'\n")
+// errUnchanged can be returned by the function passed to updateTask when
+// there is nothing to store.
+var errUnchanged = errors.New("task unchanged")
+
+// updateTask applies fn to the named task and stores the result.
+func updateTask(s Storage, name string, fn func(task *Task) error) (Task, error) {
+	task, _, err := changeTask(s, name, false, func(tx Storage, task *Task) error {
+		return fn(task)
+	})
+	return task, err
+}
+
+// updateExistingTask is updateTask for a task that has to exist already,
+// so a mistyped name is refused rather than creating a new task. fn also
+// gets the transaction, to look up other tasks in. It tells whether the
+// task was found.
+func updateExistingTask(s Storage, name string, fn func(tx Storage, task *Task) error) (Task, bool, error) {
+	return changeTask(s, name, true, fn)
+}
+
+func changeTask(s Storage, name string, mustExist bool, fn func(tx Storage, task *Task) error) (Task, bool, error) {
+	var task Task
+	var ok bool
+	err := s.Transaction(func(tx Storage) error {
+		var err error
+		if task, ok, err = tx.GetTask(name); err != nil {
+			return err
 		}
-	} else {
-		print("No field '" + fieldName + "' found for task '" + name + "'\n")
+		if err = checkRevision(name, task); err != nil {
+			return err
+		}
+		if mustExist && !ok {
+			print("No task '" + name + "' found\n")
+			exitStatus = 1
+			return errUnchanged
+		}
+		if err = fn(tx, &task); err != nil {
+			return err
+		}
+		task.Update()
+		return tx.PutTask(name, task)
+	})
+	if err == errUnchanged {
+		err = nil
 	}
-	showTask(name, task)
+	return task, ok, err
 }
 
-func writeTasks(file string, conf *TaskConfig) error {
-	var err error
-	var d []byte
-	d, err = yaml.Marshal(&conf)
+func deleteTask(s Storage, name string, recursive bool) {
+	err := s.Transaction(func(tx Storage) error {
+		task, ok, err := tx.GetTask(name)
+		if err != nil {
+			return err
+		}
+		if err = checkRevision(name, task); err != nil {
+			return err
+		}
+		if !ok {
+			print("No task '" + name + "' found\n")
+			exitStatus = 1
+			return nil
+		}
+		conf, err := tx.Load()
+		if err != nil {
+			return err
+		}
+		subtasks := descendants(conf.Tasks, name)
+		if len(subtasks) > 0 && !recursive {
+			print("Task '" + name + "' has subtasks: " + strings.Join(subtasks, ", ") + "; use --recursive to delete them too\n")
+			exitStatus = 1
+			return nil
+		}
+		for _, other := range append(subtasks, name) {
+			if err = tx.DeleteTask(other); err != nil {
+				return err
+			}
+			print("Deleted task '" + other + "'\n")
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		panic(err)
 	}
-	err = ioutil.WriteFile(file, d, 0644)
-	return err
 }
-
-func readTasks(file string) (TaskConfig, error) {
-	var conf TaskConfig
-	var err error
-	var dat []byte
-
-	if dat, err = ioutil.ReadFile(file); err != nil {
-		return conf, err
-	}
-	if err = yaml.Unmarshal(dat, &conf); err != nil {
+func createTask(s Storage, name string, titleArray []string, parent string, fieldArray []string) {
+	title := strings.Join(titleArray, " ")
+	created := false
+	task, _, err := changeTask(s, name, false, func(tx Storage, task *Task) error {
+		if !checkParent(storageLookup(tx), name, parent) {
+			return errUnchanged
+		}
+		*task = Task{
+			Title:    title,
+			Parent:   parent,
+			Revision: task.Revision,
+		}
+		schema := loadSchema(tx)
+		for _, f := range fieldArray {
+			split := strings.SplitN(f, "=", 2)
+			if len(split) != 2 {
+				print("Fields are set as field=value, not '" + f + "'\n")
+				return errUnchanged
+			}
+			value, err := checkField(schema, split[0], split[1])
+			if err != nil {
+				print(err.Error() + "\n")
+				return errUnchanged
+			}
+			if task.Fields == nil {
+				task.Fields = map[string]string{}
+			}
+			task.Fields[split[0]] = value
+		}
+		if err := applySchema(schema, task); err != nil {
+			print(err.Error() + "\n")
+			return errUnchanged
+		}
+		created = true
+		return nil
+	})
+	if err != nil {
 		panic(err)
 	}
-
-	if conf.Tasks == nil {
-		conf.Tasks = map[string]Task{}
+	if !created {
+		exitStatus = 1
+		return
 	}
-
-	return conf, nil
+	showTask(s, name, task)
 }
-func initTaskFile(file string) {
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		var conf TaskConfig
-		if err := writeTasks(file, &conf); err != nil {
-			panic(err)
+func setTaskState(s Storage, name string, state string, comment string) {
+	var task Task
+	var next string
+	refused := false
+	err := s.Transaction(func(tx Storage) error {
+		wasDone := false
+		var err error
+		task, err = updateTask(tx, name, func(task *Task) error {
+			if err := activeWorkflow.checkTransition(*task, state, comment); err != nil {
+				print(err.Error() + "\n")
+				refused = true
+				return errUnchanged
+			}
+			wasDone = task.IsDone()
+			task.State = state
+			if comment != "" {
+				task.addComment(TaskComment{
+					Comment: comment,
+					By:      parseUser("me"),
+					At:      time.Now().Format(time.RFC3339),
+				})
+			}
+			return nil
+		})
+		if err != nil || wasDone || !task.IsDone() {
+			return err
+		}
+		// A broken recurrence rule must not keep the task open.
+		if next, err = recurTask(tx, name, task, time.Now()); err != nil {
+			print("Cannot create the next instance of '" + name + "': " + err.Error() + "\n")
+			exitStatus = 1
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if refused {
+		exitStatus = 1
+		return
+	}
+	showTask(s, name, task)
+	if next != "" {
+		print("Created the next instance '" + next + "'\n")
+		if task, _, err := s.GetTask(next); err == nil {
+			showTask(s, next, task)
 		}
-	} else {
-		print("File '" + file + "' already exists!\n")
 	}
 }
 
-func Lock(file string) error {
-	msg := false
-	for {
-		if _, err := os.Stat(file); os.IsNotExist(err) {
-			err := os.Mkdir(file, 0700)
-			if !os.IsExist(err) {
-				return err
+func setTaskField(s Storage, name string, fieldName string, fieldValueArray []string) {
+	fieldValue := strings.Join(fieldValueArray, " ")
+	if fieldValue == "" {
+		unsetTaskField(s, name, fieldName)
+		return
+	}
+	fieldValue, err := checkField(loadSchema(s), fieldName, fieldValue)
+	if err != nil {
+		print(err.Error() + "\n")
+		exitStatus = 1
+		return
+	}
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		if task.Fields == nil {
+			task.Fields = map[string]string{
+				fieldName: fieldValue,
 			}
+		} else {
+			task.Fields[fieldName] = fieldValue
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+func unsetTaskField(s Storage, name string, fieldName string) {
+	refused := false
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		if _, ok := task.Fields[fieldName]; !ok {
+			print("No field '" + fieldName + "' found for task '" + name + "'\n")
+			refused = true
+			return errUnchanged
 		}
-		if !msg {
-			print("Someone has a lock; waiting...\n")
-			msg = true
+		if fs, ok := loadSchema(tx)[fieldName]; ok && fs.Required {
+			print("Field '" + fieldName + "' is required\n")
+			refused = true
+			return errUnchanged
 		}
-		time.Sleep(1 * time.Millisecond)
+		delete(task.Fields, fieldName)
+		print("Deleted field '" + fieldName + "' for task '" + name + "'\n")
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if refused {
+		exitStatus = 1
+		return
+	}
+	if ok {
+		showTask(s, name, task)
 	}
 }
 
-func Unlock(file string) error {
-	return os.Remove(file)
+func initTaskFile(file string, backend string) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		s, err := openStorage(file, backend, false)
+		if err != nil {
+			panic(err)
+		}
+		defer s.Close()
+		if err := s.Save(&TaskConfig{}); err != nil {
+			panic(err)
+		}
+	} else {
+		print("File '" + file + "' already exists!\n")
+	}
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	runewidth "github.com/mattn/go-runewidth"
+)
+
+// markdownWidth is where long lines of a comment are wrapped.
+const markdownWidth = 80
+
+const (
+	ansiBold   = "\033[1m"
+	ansiItalic = "\033[3m"
+	ansiCode   = "\033[36m"
+	ansiFaint  = "\033[2m"
+	ansiReset  = "\033[0m"
+)
+
+var (
+	fencePattern   = regexp.MustCompile("^\\s*(```|~~~)")
+	headingPattern = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	rulePattern    = regexp.MustCompile(`^\s*((-\s*){3,}|(\*\s*){3,}|(_\s*){3,})$`)
+	bulletPattern  = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	numberPattern  = regexp.MustCompile(`^(\s*)(\d+[.)])\s+(.*)$`)
+	quotePattern   = regexp.MustCompile(`^\s*>\s?(.*)$`)
+
+	codeSpanPattern = regexp.MustCompile("`([^`]+)`")
+	boldPattern     = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	italicPattern   = regexp.MustCompile(`\*([^*\s][^*]*)\*|\b_([^_\s][^_]*)_\b`)
+	linkPattern     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+)
+
+// renderMarkdown lays out a comment written in Markdown for the
+// terminal: list items get bullets, quotes a bar and code blocks are
+// indented and kept as they are. Line breaks are kept, as people write
+// comments line by line; longer lines are wrapped. With color, emphasis,
+// headings and code are highlighted and their markup is dropped.
+func renderMarkdown(text string, color bool) string {
+	style := func(s string, codes string) string {
+		if !color {
+			return s
+		}
+		return codes + s + ansiReset
+	}
+	out := []string{}
+	inCode := false
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if fencePattern.MatchString(line) {
+			inCode = !inCode
+			continue
+		}
+		listItem := bulletPattern.MatchString(line) || numberPattern.MatchString(line)
+		indented := (strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")) && !listItem
+		if inCode || indented {
+			if !inCode {
+				line = strings.TrimPrefix(strings.TrimPrefix(line, "    "), "\t")
+			}
+			// Tabs would throw off the table borders.
+			out = append(out, style("    "+strings.Replace(line, "\t", "    ", -1), ansiCode))
+			continue
+		}
+		if m := headingPattern.FindStringSubmatch(line); m != nil {
+			heading := m[2]
+			if !color {
+				heading = m[1] + " " + heading
+			}
+			out = append(out, style(heading, ansiBold))
+			continue
+		}
+		if rulePattern.MatchString(line) {
+			out = append(out, style(strings.Repeat("─", 20), ansiFaint))
+			continue
+		}
+		prefix, rest := "", line
+		if m := quotePattern.FindStringSubmatch(line); m != nil {
+			prefix, rest = "│ ", m[1]
+		} else if m := bulletPattern.FindStringSubmatch(line); m != nil {
+			prefix, rest = m[1]+"• ", m[2]
+		} else if m := numberPattern.FindStringSubmatch(line); m != nil {
+			prefix, rest = m[1]+m[2]+" ", m[3]
+		}
+		// Continued lines of a list item line up with its text.
+		indent := strings.Repeat(" ", runewidth.StringWidth(prefix))
+		if strings.HasPrefix(prefix, "│") {
+			indent = prefix
+		}
+		for i, l := range wrapLine(rest, markdownWidth-runewidth.StringWidth(indent)) {
+			if i == 0 {
+				out = append(out, prefix+renderInline(l, color))
+			} else {
+				out = append(out, indent+renderInline(l, color))
+			}
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// renderInline highlights code, emphasis and links within a line.
+func renderInline(line string, color bool) string {
+	line = linkPattern.ReplaceAllString(line, "$1 ($2)")
+	if !color {
+		return line
+	}
+	// Code spans are set aside first, so nothing in them is taken for
+	// emphasis.
+	spans := []string{}
+	line = codeSpanPattern.ReplaceAllStringFunc(line, func(s string) string {
+		spans = append(spans, s[1:len(s)-1])
+		return "\x00"
+	})
+	line = boldPattern.ReplaceAllString(line, ansiBold+"$1$2"+ansiReset)
+	line = italicPattern.ReplaceAllString(line, ansiItalic+"$1$2"+ansiReset)
+	for _, s := range spans {
+		line = strings.Replace(line, "\x00", ansiCode+s+ansiReset, 1)
+	}
+	return line
+}
+
+// wrapLine breaks a line between words so that the parts are at most
+// width wide, unless a single word is longer.
+func wrapLine(line string, width int) []string {
+	if runewidth.StringWidth(line) <= width {
+		return []string{line}
+	}
+	lines := []string{}
+	current := ""
+	for _, word := range strings.Fields(line) {
+		if current != "" && runewidth.StringWidth(current+" "+word) > width {
+			lines = append(lines, current)
+			current = ""
+		}
+		if current != "" {
+			current += " "
+		}
+		current += word
+	}
+	return append(lines, current)
+}
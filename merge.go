@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A git merge driver for task files. Configure it with
+//
+//	git config merge.task.driver "task merge-driver %O %A %B"
+//
+// and mark the task file with "merge=task" in .gitattributes. The merged
+// result is written to the "ours" file; the exit code is non-zero when
+// there are conflicts left to resolve by hand.
+
+type merger struct {
+	conflicts []string
+}
+
+func mergeDriver(baseFile string, oursFile string, theirsFile string) int {
+	var base, ours, theirs []byte
+	var err error
+
+	if base, err = ioutil.ReadFile(baseFile); err != nil {
+		panic(err)
+	}
+	if ours, err = ioutil.ReadFile(oursFile); err != nil {
+		panic(err)
+	}
+	if theirs, err = ioutil.ReadFile(theirsFile); err != nil {
+		panic(err)
+	}
+
+	m := &merger{}
+	result, err := m.mergeDocuments(base, ours, theirs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "merge-driver: "+err.Error())
+		return 2
+	}
+	if err = writeFileAtomic(oursFile, result, 0644, 0); err != nil {
+		panic(err)
+	}
+
+	for _, conflict := range m.conflicts {
+		fmt.Fprintln(os.Stderr, "CONFLICT: "+conflict)
+	}
+	if len(m.conflicts) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// mergeDocuments merges whole task files, or single task files from the
+// directory layout. The result is written in the format of ours: git
+// hands the driver temporary files without an extension, so JSON is
+// recognised by its content.
+func (m *merger) mergeDocuments(base []byte, ours []byte, theirs []byte) ([]byte, error) {
+	var c codec = yamlCodec{}
+	if bytes.HasPrefix(bytes.TrimSpace(ours), []byte("{")) {
+		c = jsonCodec{}
+	}
+
+	// Single task files have no version of their own; as migrations
+	// leave upgraded tasks alone, running all of them is safe.
+	if !isTaskConfig(ours) {
+		var tasks [3]Task
+		for i, dat := range [][]byte{base, ours, theirs} {
+			var err error
+			if tasks[i], err = decodeTaskData(yamlCodec{}, dat, 0); err != nil {
+				return nil, err
+			}
+		}
+		return c.Marshal(m.mergeTask("", tasks[0], tasks[1], tasks[2]))
+	}
+
+	var confs [3]TaskConfig
+	for i, dat := range [][]byte{base, ours, theirs} {
+		var err error
+		if confs[i], err = decodeConfig(yamlCodec{}, dat); err != nil {
+			return nil, err
+		}
+	}
+	result := m.mergeConfig(confs[0], confs[1], confs[2])
+	result.Version = currentFormatVersion
+	return c.Marshal(&result)
+}
+
+func isTaskConfig(dat []byte) bool {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(dat, &doc); err != nil {
+		return true
+	}
+	_, hasTitle := doc["title"]
+	return !hasTitle
+}
+
+func (m *merger) mergeConfig(o TaskConfig, a TaskConfig, b TaskConfig) TaskConfig {
+	result := TaskConfig{Tasks: map[string]Task{}}
+	result.Schema = m.mergeSchema(o.Schema, a.Schema, b.Schema)
+	result.Workflow = a.Workflow
+	if !sameJSON(a.Workflow, b.Workflow) && !sameJSON(o.Workflow, b.Workflow) {
+		if sameJSON(o.Workflow, a.Workflow) {
+			result.Workflow = b.Workflow
+		} else {
+			m.conflict("", "workflow: changed on both sides, kept ours")
+		}
+	}
+
+	names := map[string]bool{}
+	for name := range a.Tasks {
+		names[name] = true
+	}
+	for name := range b.Tasks {
+		names[name] = true
+	}
+
+	for name := range names {
+		ot, inO := o.Tasks[name]
+		at, inA := a.Tasks[name]
+		bt, inB := b.Tasks[name]
+		switch {
+		case inA && inB:
+			result.Tasks[name] = m.mergeTask(name, ot, at, bt)
+		case inA && !inO:
+			result.Tasks[name] = at
+		case inB && !inO:
+			result.Tasks[name] = bt
+		case inA:
+			// Deleted by them; keep it only if we changed it since.
+			if !sameTask(ot, at) {
+				m.conflict(name, "deleted by them, modified by us")
+				result.Tasks[name] = at
+			}
+		case inB:
+			if !sameTask(ot, bt) {
+				m.conflict(name, "deleted by us, modified by them")
+				result.Tasks[name] = bt
+			}
+		}
+	}
+
+	return result
+}
+
+// mergeSchema merges the schema field by field. A field changed
+// differently on both sides is a conflict; ours is kept.
+func (m *merger) mergeSchema(o map[string]FieldSchema, a map[string]FieldSchema, b map[string]FieldSchema) map[string]FieldSchema {
+	result := map[string]FieldSchema{}
+	names := map[string]bool{}
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+	for name := range names {
+		of, inO := o[name]
+		af, inA := a[name]
+		bf, inB := b[name]
+		switch {
+		case inA && inB:
+			result[name] = af
+			if !sameJSON(af, bf) && !sameJSON(of, bf) {
+				if sameJSON(of, af) {
+					result[name] = bf
+				} else {
+					m.conflict("", "schema field '"+name+"': changed on both sides, kept ours")
+				}
+			}
+		case inA && (!inO || !sameJSON(of, af)):
+			result[name] = af
+		case inB && (!inO || !sameJSON(of, bf)):
+			result[name] = bf
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func (m *merger) conflict(task string, msg string) {
+	if task == "" {
+		m.conflicts = append(m.conflicts, msg)
+		return
+	}
+	m.conflicts = append(m.conflicts, "task '"+task+"': "+msg)
+}
+
+func sameTask(a Task, b Task) bool {
+	return sameJSON(a, b)
+}
+
+func sameJSON(a interface{}, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+func (m *merger) mergeTask(name string, o Task, a Task, b Task) Task {
+	result := a
+
+	result.Title = m.mergeString(name, "title", o.Title, a.Title, b.Title)
+	result.Assignees = mergeSet(o.Assignees, a.Assignees, b.Assignees)
+	result.Watchers = mergeSet(o.Watchers, a.Watchers, b.Watchers)
+	result.State = m.mergeString(name, "state", o.State, a.State, b.State)
+	result.Tags = mergeSet(o.Tags, a.Tags, b.Tags)
+	sort.Strings(result.Tags)
+	result.AfterTasks = mergeSet(o.AfterTasks, a.AfterTasks, b.AfterTasks)
+	result.Parent = m.mergeString(name, "parent", o.Parent, a.Parent, b.Parent)
+	result.Due = m.mergeString(name, "due", o.Due, a.Due, b.Due)
+	result.Estimate = *m.mergeAmount(name, "estimate", &o.Estimate, &a.Estimate, &b.Estimate)
+	result.Remaining = m.mergeAmount(name, "remaining", o.Remaining, a.Remaining, b.Remaining)
+	result.Recur = m.mergeString(name, "recur", o.Recur, a.Recur, b.Recur)
+	result.Previous = m.mergeString(name, "previous", o.Previous, a.Previous, b.Previous)
+	result.Fields = m.mergeFields(name, o.Fields, a.Fields, b.Fields)
+	result.Comments = mergeComments(o.Comments, a.Comments, b.Comments)
+	result.pruneComments()
+	result.Worklog = mergeWorklog(a.Worklog, b.Worklog)
+
+	// Timestamps never conflict: the task was created at the earliest
+	// and updated at the latest time either side knows about.
+	result.CreatedAt = minTime(a.CreatedAt, b.CreatedAt)
+	result.UpdatedAt = maxTime(a.UpdatedAt, b.UpdatedAt)
+
+	// When both sides changed the task, the merge is a change of its
+	// own.
+	result.Revision = a.Revision
+	if b.Revision > result.Revision {
+		result.Revision = b.Revision
+	}
+	if a.Revision != o.Revision && b.Revision != o.Revision {
+		result.Revision++
+	}
+
+	return result
+}
+
+// mergeString does a three-way merge of a single value. When both sides
+// changed it differently, the result holds both versions between
+// conflict markers.
+func (m *merger) mergeString(name string, field string, o string, a string, b string) string {
+	switch {
+	case a == b:
+		return a
+	case a == o:
+		return b
+	case b == o:
+		return a
+	}
+	m.conflict(name, "both sides changed '"+field+"'")
+	return "<<<<<<< ours\n" + a + "\n=======\n" + b + "\n>>>>>>> theirs"
+}
+
+// mergeAmount is mergeString for amounts of work. There is no place for
+// conflict markers in a number, so on a conflict ours is kept.
+func (m *merger) mergeAmount(name string, field string, o *float64, a *float64, b *float64) *float64 {
+	switch {
+	case sameJSON(a, b):
+		return a
+	case sameJSON(a, o):
+		return b
+	case sameJSON(b, o):
+		return a
+	}
+	m.conflict(name, "both sides changed '"+field+"', kept ours")
+	return a
+}
+
+func (m *merger) mergeFields(name string, o map[string]string, a map[string]string, b map[string]string) map[string]string {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	for k := range o {
+		keys[k] = true
+	}
+
+	result := map[string]string{}
+	for k := range keys {
+		ov, inO := o[k]
+		av, inA := a[k]
+		bv, inB := b[k]
+		switch {
+		case inA && inB:
+			result[k] = m.mergeString(name, k, ov, av, bv)
+		case inA && (!inO || av != ov):
+			if inO {
+				m.conflict(name, "'"+k+"' unset by them, changed by us")
+			}
+			result[k] = av
+		case inB && (!inO || bv != ov):
+			if inO {
+				m.conflict(name, "'"+k+"' unset by us, changed by them")
+			}
+			result[k] = bv
+		}
+	}
+
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// mergeSet keeps every element present on either side, except those that
+// one side removed.
+func mergeSet(o []string, a []string, b []string) []string {
+	removed := map[string]bool{}
+	for _, v := range o {
+		if !contains(a, v) || !contains(b, v) {
+			removed[v] = true
+		}
+	}
+
+	var result []string
+	for _, v := range append(append([]string{}, a...), b...) {
+		if !removed[v] && !contains(result, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeWorklog combines the work entries of both sides; an entry is
+// identified by who started it when, and a stopped timer wins over the
+// same timer still running.
+func mergeWorklog(a []WorkEntry, b []WorkEntry) []WorkEntry {
+	var result []WorkEntry
+	index := map[string]int{}
+	for _, w := range append(append([]WorkEntry{}, a...), b...) {
+		key := w.User + "\x00" + w.Start
+		if i, ok := index[key]; ok {
+			if result[i].Running() {
+				result[i] = w
+			}
+			continue
+		}
+		index[key] = len(result)
+		result = append(result, w)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return parseTime(result[i].Start).Before(parseTime(result[j].Start))
+	})
+	return result
+}
+
+// mergeComments combines the comments of both sides by ID, ordered by
+// time. A comment deleted on either side stays deleted, and of a comment
+// changed on both sides the latest change wins.
+func mergeComments(o []TaskComment, a []TaskComment, b []TaskComment) []TaskComment {
+	removed := map[string]bool{}
+	for _, c := range o {
+		if !hasComment(a, c) || !hasComment(b, c) {
+			removed[commentKey(c)] = true
+		}
+	}
+
+	var result []TaskComment
+	index := map[string]int{}
+	for _, c := range append(append([]TaskComment{}, a...), b...) {
+		key := commentKey(c)
+		if removed[key] {
+			continue
+		}
+		if i, ok := index[key]; ok {
+			if parseTime(c.EditedAt).After(parseTime(result[i].EditedAt)) {
+				result[i] = c
+			}
+			continue
+		}
+		index[key] = len(result)
+		result = append(result, c)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return parseTime(result[i].At).Before(parseTime(result[j].At))
+	})
+	return result
+}
+
+// commentKey identifies a comment; comments from before comment IDs are
+// told apart by who wrote what when.
+func commentKey(c TaskComment) string {
+	if c.ID != "" {
+		return c.ID
+	}
+	return c.At + "\x00" + c.By + "\x00" + c.Comment
+}
+
+func hasComment(list []TaskComment, c TaskComment) bool {
+	for _, other := range list {
+		if commentKey(other) == commentKey(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// minTime and maxTime compare RFC3339 timestamps, ignoring empty ones.
+func minTime(a string, b string) string {
+	if a == "" || (b != "" && parseTime(b).Before(parseTime(a))) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a string, b string) string {
+	if a == "" || (b != "" && parseTime(b).After(parseTime(a))) {
+		return b
+	}
+	return a
+}
+
+func parseTime(theTime string) time.Time {
+	t, _ := time.Parse(time.RFC3339, theTime)
+	return t
+}
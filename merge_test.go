@@ -0,0 +1,200 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeString(t *testing.T) {
+	tests := []struct {
+		o, a, b  string
+		want     string
+		conflict bool
+	}{
+		{"x", "x", "x", "x", false},
+		{"x", "y", "x", "y", false},
+		{"x", "x", "y", "y", false},
+		{"x", "y", "y", "y", false},
+		{"", "y", "", "y", false},
+		{"x", "y", "z", "<<<<<<< ours\ny\n=======\nz\n>>>>>>> theirs", true},
+		{"", "y", "z", "<<<<<<< ours\ny\n=======\nz\n>>>>>>> theirs", true},
+	}
+	for _, test := range tests {
+		m := &merger{}
+		got := m.mergeString("t", "title", test.o, test.a, test.b)
+		if got != test.want {
+			t.Errorf("mergeString(%q, %q, %q) = %q, want %q", test.o, test.a, test.b, got, test.want)
+		}
+		if conflict := len(m.conflicts) > 0; conflict != test.conflict {
+			t.Errorf("mergeString(%q, %q, %q): conflict %v, want %v", test.o, test.a, test.b, conflict, test.conflict)
+		}
+	}
+}
+
+func TestMergeSet(t *testing.T) {
+	tests := []struct {
+		o, a, b []string
+		want    []string
+	}{
+		{nil, nil, nil, nil},
+		{nil, []string{"x"}, []string{"y"}, []string{"x", "y"}},
+		{[]string{"x"}, []string{"x"}, []string{"x", "y"}, []string{"x", "y"}},
+		{[]string{"x", "y"}, []string{"y"}, []string{"x", "y", "z"}, []string{"y", "z"}},
+		{[]string{"x"}, nil, []string{"x"}, nil},
+		{nil, []string{"x"}, []string{"x"}, []string{"x"}},
+	}
+	for _, test := range tests {
+		if got := mergeSet(test.o, test.a, test.b); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("mergeSet(%v, %v, %v) = %v, want %v", test.o, test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestMergeComments(t *testing.T) {
+	first := TaskComment{ID: "1111111", Comment: "first", By: "ann", At: "2026-01-01T10:00:00Z"}
+	second := TaskComment{ID: "2222222", Comment: "second", By: "bob", At: "2026-01-02T10:00:00Z"}
+	third := TaskComment{ID: "3333333", Comment: "third", By: "ann", At: "2026-01-03T10:00:00Z"}
+	edited := first
+	edited.Comment, edited.EditedAt = "first, edited", "2026-01-04T10:00:00Z"
+	legacy := TaskComment{Comment: "old", By: "ann", At: "2025-12-01T10:00:00Z"}
+
+	tests := []struct {
+		name    string
+		o, a, b []TaskComment
+		want    []TaskComment
+	}{
+		{"added on both sides", []TaskComment{first}, []TaskComment{first, third}, []TaskComment{first, second}, []TaskComment{first, second, third}},
+		{"deleted by them", []TaskComment{first, second}, []TaskComment{first, second}, []TaskComment{second}, []TaskComment{second}},
+		{"deleted by us, edited by them", []TaskComment{first}, nil, []TaskComment{edited}, nil},
+		{"edited by them", []TaskComment{first}, []TaskComment{first}, []TaskComment{edited}, []TaskComment{edited}},
+		{"edited by us", []TaskComment{first}, []TaskComment{edited}, []TaskComment{first}, []TaskComment{edited}},
+		{"without IDs", []TaskComment{legacy}, []TaskComment{legacy, first}, []TaskComment{legacy}, []TaskComment{legacy, first}},
+	}
+	for _, test := range tests {
+		if got := mergeComments(test.o, test.a, test.b); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: mergeComments() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// Comments from before comment IDs get theirs when the file is read, so
+// a side that was already upgraded matches one that was not.
+func TestMergeDocumentsMigratedComments(t *testing.T) {
+	at := "2026-01-01T10:00:00Z"
+	id := commentID("ann", at, "hello", func(string) bool { return false })
+	v4 := func(comments string) []byte {
+		return []byte("version: 4\ntasks:\n  t:\n    title: T\n    comments:\n" + comments)
+	}
+	hello := "    - comment: hello\n      by: ann\n      at: " + at + "\n"
+	bye := "    - comment: bye\n      by: bob\n      at: 2026-01-02T10:00:00Z\n"
+	v5 := []byte("version: 5\ntasks:\n  t:\n    title: T\n    comments:\n    - id: " + id + "\n      comment: hello\n      by: ann\n      at: " + at + "\n")
+
+	tests := []struct {
+		name       string
+		base, a, b []byte
+		want       []string
+		conflicts  int
+	}{
+		{"same comment", v4(hello), v5, v4(hello), []string{"hello"}, 0},
+		{"added by them", v4(hello), v5, v4(hello + bye), []string{"hello", "bye"}, 0},
+		{"deleted by them", v4(hello), v5, []byte("version: 4\ntasks:\n  t:\n    title: T\n"), nil, 0},
+	}
+	for _, test := range tests {
+		m := &merger{}
+		dat, err := m.mergeDocuments(test.base, test.a, test.b)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		conf, err := decodeConfig(yamlCodec{}, dat)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var got []string
+		for _, c := range conf.Tasks["t"].Comments {
+			got = append(got, c.Comment)
+			if c.ID == "" {
+				t.Errorf("%s: comment %q has no ID", test.name, c.Comment)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: comments %v, want %v", test.name, got, test.want)
+		}
+		if conf.Version != currentFormatVersion {
+			t.Errorf("%s: version %d, want %d", test.name, conf.Version, currentFormatVersion)
+		}
+		if len(m.conflicts) != test.conflicts {
+			t.Errorf("%s: conflicts %v", test.name, m.conflicts)
+		}
+	}
+}
+
+func TestMergeDocumentsConflicts(t *testing.T) {
+	doc := func(title string, state string) []byte {
+		return []byte("version: 5\ntasks:\n  t:\n    title: " + title + "\n    state: " + state + "\n")
+	}
+	tests := []struct {
+		name       string
+		base, a, b []byte
+		title      string
+		state      string
+		conflicts  int
+	}{
+		{"one side", doc("T", "todo"), doc("T", "done"), doc("T", "todo"), "T", "done", 0},
+		{"different fields", doc("T", "todo"), doc("U", "todo"), doc("T", "done"), "U", "done", 0},
+		{"same change", doc("T", "todo"), doc("T", "done"), doc("T", "done"), "T", "done", 0},
+		{"both sides", doc("T", "todo"), doc("T", "done"), doc("T", "doing"), "T", "<<<<<<< ours\ndone\n=======\ndoing\n>>>>>>> theirs", 1},
+	}
+	for _, test := range tests {
+		m := &merger{}
+		dat, err := m.mergeDocuments(test.base, test.a, test.b)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		conf, err := decodeConfig(yamlCodec{}, dat)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		task := conf.Tasks["t"]
+		if task.Title != test.title || task.State != test.state {
+			t.Errorf("%s: got title %q, state %q, want %q, %q", test.name, task.Title, task.State, test.title, test.state)
+		}
+		if len(m.conflicts) != test.conflicts {
+			t.Errorf("%s: conflicts %v, want %d", test.name, m.conflicts, test.conflicts)
+		}
+		for _, c := range m.conflicts {
+			if !strings.HasPrefix(c, "task 't': ") {
+				t.Errorf("%s: conflict %q does not name the task", test.name, c)
+			}
+		}
+	}
+}
+
+func TestMergeConfigDeleted(t *testing.T) {
+	task := Task{Title: "T", Revision: 1}
+	changed := Task{Title: "U", Revision: 2}
+	conf := func(tasks map[string]Task) TaskConfig {
+		return TaskConfig{Tasks: tasks}
+	}
+	tests := []struct {
+		name      string
+		o, a, b   TaskConfig
+		want      bool
+		conflicts int
+	}{
+		{"deleted by them", conf(map[string]Task{"t": task}), conf(map[string]Task{"t": task}), conf(map[string]Task{}), false, 0},
+		{"deleted by us", conf(map[string]Task{"t": task}), conf(map[string]Task{}), conf(map[string]Task{"t": task}), false, 0},
+		{"deleted by them, modified by us", conf(map[string]Task{"t": task}), conf(map[string]Task{"t": changed}), conf(map[string]Task{}), true, 1},
+		{"added by them", conf(map[string]Task{}), conf(map[string]Task{}), conf(map[string]Task{"t": task}), true, 0},
+	}
+	for _, test := range tests {
+		m := &merger{}
+		result := m.mergeConfig(test.o, test.a, test.b)
+		if _, ok := result.Tasks["t"]; ok != test.want {
+			t.Errorf("%s: task kept %v, want %v", test.name, ok, test.want)
+		}
+		if len(m.conflicts) != test.conflicts {
+			t.Errorf("%s: conflicts %v, want %d", test.name, m.conflicts, test.conflicts)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/olekukonko/tablewriter"
+)
+
+// Weights of the parts of the score of a suggestion.
+const (
+	priorityWeight = 10.0
+	// A task due today or overdue gets the full weight, one due in
+	// dueHorizon days or later nothing.
+	dueWeight  = 30.0
+	dueHorizon = 14.0
+	// Waiting longer counts up to ageCap days.
+	ageWeight = 10.0
+	ageCap    = 30.0
+	// Per task that can start once this one is done.
+	unblockWeight = 5.0
+)
+
+var priorityNames = map[string]float64{
+	"critical": 4,
+	"high":     3,
+	"medium":   2,
+	"normal":   2,
+	"low":      1,
+}
+
+type Suggestion struct {
+	Name     string  `json:"name"`
+	Title    string  `json:"title"`
+	Score    float64 `json:"score"`
+	Priority string  `json:"priority,omitempty"`
+	Due      string  `json:"due,omitempty"`
+	Unblocks int     `json:"unblocks"`
+	Age      string  `json:"age,omitempty"`
+}
+
+// taskPriority reads the "priority" field, either as a number or a name;
+// higher is more important.
+func taskPriority(task Task) float64 {
+	value := strings.ToLower(task.Fields["priority"])
+	if p, ok := priorityNames[value]; ok {
+		return p
+	}
+	p, _ := strconv.ParseFloat(value, 64)
+	return p
+}
+
+// unblockCount counts the open tasks that (indirectly) wait for name.
+func unblockCount(tasks map[string]Task, name string) int {
+	waiting := map[string][]string{}
+	for other, task := range tasks {
+		if task.IsDone() {
+			continue
+		}
+		for _, after := range task.AfterTasks {
+			waiting[after] = append(waiting[after], other)
+		}
+	}
+
+	seen := map[string]bool{}
+	var walk func(name string)
+	walk = func(name string) {
+		for _, other := range waiting[name] {
+			if !seen[other] {
+				seen[other] = true
+				walk(other)
+			}
+		}
+	}
+	walk(name)
+	return len(seen)
+}
+
+func suggestTasks(conf *TaskConfig, user string, now time.Time) []Suggestion {
+	lookup := mapLookup(conf.Tasks)
+	suggestions := []Suggestion{}
+	for name, task := range conf.Tasks {
+		if task.IsDone() || len(blockers(lookup, task)) > 0 {
+			continue
+		}
+		if len(task.Assignees) > 0 && !task.IsAssignedTo(user) {
+			continue
+		}
+
+		s := Suggestion{Name: name, Title: task.Title, Priority: task.Fields["priority"]}
+		s.Score += priorityWeight * taskPriority(task)
+		if due, ok := taskDue(task); ok {
+			s.Due = humanize.Time(due)
+			days := due.Sub(now).Hours() / 24
+			s.Score += dueWeight * math.Max(0, math.Min(1, 1-days/dueHorizon))
+		}
+		if created, err := time.Parse(time.RFC3339, task.CreatedAt); err == nil {
+			s.Age = humanize.Time(created)
+			days := now.Sub(created).Hours() / 24
+			s.Score += ageWeight * math.Min(days, ageCap) / ageCap
+		}
+		s.Unblocks = unblockCount(conf.Tasks, name)
+		s.Score += unblockWeight * float64(s.Unblocks)
+		s.Score = math.Round(s.Score*10) / 10
+
+		suggestions = append(suggestions, s)
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Score != suggestions[j].Score {
+			return suggestions[i].Score > suggestions[j].Score
+		}
+		return suggestions[i].Name < suggestions[j].Name
+	})
+	return suggestions
+}
+
+func showNext(conf *TaskConfig, user string) {
+	suggestions := suggestTasks(conf, parseUser(user), time.Now())
+	switch *exportFormat {
+	case "table":
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetColWidth(100)
+		table.SetHeader([]string{"#", "Name", "Title", "Score", "Priority", "Due", "Unblocks", "Created"})
+		for i, s := range suggestions {
+			table.Append([]string{strconv.Itoa(i + 1), s.Name, s.Title, strconv.FormatFloat(s.Score, 'f', 1, 64), s.Priority, s.Due, strconv.Itoa(s.Unblocks), s.Age})
+		}
+		table.Render()
+	case "json":
+		res, _ := json.Marshal(suggestions)
+		fmt.Println(string(res))
+	}
+}
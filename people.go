@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+)
+
+func (t *Task) IsAssignedTo(user string) bool {
+	return contains(t.Assignees, user)
+}
+
+func (t *Task) IsWatchedBy(user string) bool {
+	return contains(t.Watchers, user)
+}
+
+// people returns the assignees or watchers of a task, for filters on
+// "assignee" and "watcher".
+func (t *Task) people(field string) ([]string, bool) {
+	switch field {
+	case "assignee":
+		return t.Assignees, true
+	case "watcher":
+		return t.Watchers, true
+	}
+	return nil, false
+}
+
+// parseUsers resolves every user with parseUser; no users at all means
+// 'me' and 'none' means nobody.
+func parseUsers(users []string) []string {
+	if len(users) == 0 {
+		users = []string{"me"}
+	}
+	result := []string{}
+	for _, user := range users {
+		if user = parseUser(user); user != "" && !contains(result, user) {
+			result = append(result, user)
+		}
+	}
+	return result
+}
+
+// addPeople adds the users that are not in list yet, and tells whether
+// there were any.
+func addPeople(list []string, users []string) ([]string, bool) {
+	added := false
+	for _, user := range users {
+		if !contains(list, user) {
+			list = append(list, user)
+			added = true
+		}
+	}
+	return list, added
+}
+
+// removePeople removes users from list, and tells whether any of them
+// were in it.
+func removePeople(list []string, users []string) ([]string, bool) {
+	kept := []string{}
+	for _, user := range list {
+		if !contains(users, user) {
+			kept = append(kept, user)
+		}
+	}
+	if len(kept) == 0 {
+		kept = nil
+	}
+	return kept, len(kept) != len(list)
+}
+
+// assignTask sets the assignees of a task, or with add or remove changes
+// them.
+func assignTask(s Storage, name string, users []string, add bool, remove bool) {
+	if add && remove {
+		print("Use either --add or --remove\n")
+		exitStatus = 1
+		return
+	}
+	assignees := parseUsers(users)
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		changed := true
+		switch {
+		case add:
+			task.Assignees, changed = addPeople(task.Assignees, assignees)
+		case remove:
+			task.Assignees, changed = removePeople(task.Assignees, assignees)
+		default:
+			if len(assignees) == 0 {
+				assignees = nil
+			}
+			task.Assignees = assignees
+		}
+		if !changed {
+			print("Nothing to change in the assignees of '" + name + "'\n")
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+func watchTask(s Storage, name string, users []string) {
+	watchers := parseUsers(users)
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		var added bool
+		if task.Watchers, added = addPeople(task.Watchers, watchers); !added {
+			print("Already watching '" + name + "'\n")
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+func unwatchTask(s Storage, name string, users []string) {
+	watchers := parseUsers(users)
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		var removed bool
+		if task.Watchers, removed = removePeople(task.Watchers, watchers); !removed {
+			print("Not watching '" + name + "'\n")
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+func joinPeople(users []string) string {
+	return strings.Join(users, ", ")
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A recurrence rule is one of
+//
+//	daily, weekly, monthly, yearly
+//	every <span>         e.g. every 2w; counted from the previous due date
+//	after <span>         e.g. after 3d; counted from when the task was done
+//	<cron expression>    minute hour day-of-month month day-of-week
+//
+// When a recurring task is done, a new instance is created with the next
+// due date. Fixed schedules skip instances that would already be overdue.
+type recurrence struct {
+	span  string
+	after bool
+	cron  *cronSchedule
+}
+
+var namedRecurrences = map[string]string{
+	"daily":   "1d",
+	"weekly":  "1w",
+	"monthly": "1mo",
+	"yearly":  "1y",
+}
+
+func parseRecurrence(rule string) (recurrence, error) {
+	rule = strings.Join(strings.Fields(strings.ToLower(rule)), " ")
+	if span, ok := namedRecurrences[rule]; ok {
+		return recurrence{span: span}, nil
+	}
+	for _, prefix := range []string{"every ", "after "} {
+		if strings.HasPrefix(rule, prefix) {
+			span := strings.TrimPrefix(rule, prefix)
+			next, _, err := addSpan(time.Time{}, span)
+			if err != nil {
+				return recurrence{}, err
+			}
+			if next.IsZero() {
+				return recurrence{}, fmt.Errorf("a task cannot repeat every %s; use a span longer than zero", span)
+			}
+			return recurrence{span: span, after: prefix == "after "}, nil
+		}
+	}
+	if len(strings.Fields(rule)) == 5 {
+		cron, err := parseCron(rule)
+		if err != nil {
+			return recurrence{}, err
+		}
+		if _, ok := cron.next(time.Now()); !ok {
+			return recurrence{}, fmt.Errorf("the cron expression '%s' never matches", rule)
+		}
+		return recurrence{cron: cron}, nil
+	}
+	return recurrence{}, fmt.Errorf("cannot understand '%s' as a recurrence; use daily, weekly, monthly, yearly, 'every 2w', 'after 3d' or a cron expression", rule)
+}
+
+// maxSkippedInstances bounds how many overdue instances nextDue skips;
+// an hourly task is caught up on more than ten years.
+const maxSkippedInstances = 100000
+
+// nextDue returns the due date of the instance after task, which was done
+// at the given time.
+func (r recurrence) nextDue(task Task, done time.Time) (string, error) {
+	if r.cron != nil {
+		start := done
+		if due, ok := taskDue(task); ok && due.After(start) {
+			start = due
+		}
+		next, ok := r.cron.next(start)
+		if !ok {
+			return "", fmt.Errorf("the cron expression never matches")
+		}
+		return next.Format(time.RFC3339), nil
+	}
+
+	var from time.Time
+	isDate := true
+	if !r.after && task.Due != "" {
+		if t, err := time.ParseInLocation(dateFormat, task.Due, time.Local); err == nil {
+			from = t
+		} else if t, err := time.Parse(time.RFC3339, task.Due); err == nil {
+			from, isDate = t, false
+		}
+	}
+	if from.IsZero() {
+		from = startOfDay(done)
+	}
+
+	next, spanIsDate, err := addSpan(from, r.span)
+	if err != nil {
+		return "", err
+	}
+	isDate = isDate && spanIsDate
+	for skipped := 0; !r.after; skipped++ {
+		end, _ := dueEnd(formatDue(next, isDate))
+		if end.After(done) {
+			break
+		}
+		following, _, _ := addSpan(next, r.span)
+		if !following.After(next) || skipped == maxSkippedInstances {
+			return "", fmt.Errorf("cannot find the next due date after %s with '%s'", formatDue(next, isDate), task.Recur)
+		}
+		next = following
+	}
+	return formatDue(next, isDate), nil
+}
+
+func formatDue(t time.Time, isDate bool) string {
+	if isDate {
+		return formatDate(t)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// cronSchedule is a parsed cron expression; every field holds the
+// matching values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	// Like cron, a restricted day of month or day of week matches if
+	// either does.
+	anyDom, anyDow bool
+}
+
+var cronField = regexp.MustCompile(`^(\*|\d+(?:-\d+)?)(?:/(\d+))?$`)
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		m := cronField.FindStringSubmatch(part)
+		if m == nil {
+			return nil, fmt.Errorf("invalid cron field '%s'", field)
+		}
+		lo, hi := min, max
+		if m[1] != "*" {
+			bounds := strings.SplitN(m[1], "-", 2)
+			lo, _ = strconv.Atoi(bounds[0])
+			hi = lo
+			if len(bounds) == 2 {
+				hi, _ = strconv.Atoi(bounds[1])
+			} else if m[2] != "" {
+				hi = max
+			}
+		}
+		step := 1
+		if m[2] != "" {
+			step, _ = strconv.Atoi(m[2])
+		}
+		if lo < min || hi > max || lo > hi || step < 1 {
+			return nil, fmt.Errorf("invalid cron field '%s'", field)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	c := &cronSchedule{anyDom: fields[2] == "*", anyDow: fields[4] == "*"}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Sunday is both 0 and 7.
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	return c, nil
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first time after t matching the schedule, looking a
+// few years ahead at most.
+func (c *cronSchedule) next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = startOfDay(t).AddDate(0, 0, 1)
+		case !c.hour[t.Hour()]:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+var instanceSuffix = regexp.MustCompile(`^(.*)-(\d+)$`)
+
+// nextInstanceName picks a free name for the instance after name: task-2,
+// task-3 and so on.
+func nextInstanceName(tasks map[string]Task, name string) string {
+	base, n := name, 1
+	if m := instanceSuffix.FindStringSubmatch(name); m != nil {
+		base = m[1]
+		n, _ = strconv.Atoi(m[2])
+	}
+	for {
+		n++
+		candidate := base + "-" + strconv.Itoa(n)
+		if _, ok := tasks[candidate]; !ok {
+			return candidate
+		}
+	}
+}
+
+// successors returns the instances created after the given one.
+func successors(tasks map[string]Task, name string) []string {
+	result := []string{}
+	for other, task := range tasks {
+		if task.Previous == name {
+			result = append(result, other)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// recurTask creates the next instance of a recurring task that was just
+// done. It returns the name of the new task, or "" if there is none.
+func recurTask(tx Storage, name string, task Task, done time.Time) (string, error) {
+	if task.Recur == "" {
+		return "", nil
+	}
+	r, err := parseRecurrence(task.Recur)
+	if err != nil {
+		return "", err
+	}
+	conf, err := tx.Load()
+	if err != nil {
+		return "", err
+	}
+	// Reopening and finishing a task again does not repeat it twice.
+	if len(successors(conf.Tasks, name)) > 0 {
+		return "", nil
+	}
+	due, err := r.nextDue(task, done)
+	if err != nil {
+		return "", err
+	}
+
+	next := Task{
+		Title:     task.Title,
+		Assignees: append([]string(nil), task.Assignees...),
+		Watchers:  append([]string(nil), task.Watchers...),
+		Tags:      append([]string(nil), task.Tags...),
+		Estimate:  task.Estimate,
+		Parent:    task.Parent,
+		Due:       due,
+		Recur:     task.Recur,
+		Previous:  name,
+	}
+	if len(task.Fields) > 0 {
+		next.Fields = map[string]string{}
+		for k, v := range task.Fields {
+			next.Fields[k] = v
+		}
+	}
+	next.Update()
+	nextName := nextInstanceName(conf.Tasks, name)
+	return nextName, tx.PutTask(nextName, next)
+}
+
+func setTaskRecurrence(s Storage, name string, ruleArray []string) {
+	rule := strings.Join(ruleArray, " ")
+	if rule == "none" {
+		rule = ""
+	}
+	if rule != "" {
+		if _, err := parseRecurrence(rule); err != nil {
+			print(err.Error() + "\n")
+			exitStatus = 1
+			return
+		}
+	}
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		task.Recur = rule
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
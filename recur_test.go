@@ -0,0 +1,192 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRecurrence(t *testing.T) {
+	tests := []struct {
+		rule  string
+		want  recurrence
+		valid bool
+	}{
+		{"daily", recurrence{span: "1d"}, true},
+		{"Monthly", recurrence{span: "1mo"}, true},
+		{"every 2w", recurrence{span: "2w"}, true},
+		{"every  12h", recurrence{span: "12h"}, true},
+		{"after 3d", recurrence{span: "3d", after: true}, true},
+		{"0 9 * * 1-5", recurrence{}, true},
+		{"every", recurrence{}, false},
+		{"every 2x", recurrence{}, false},
+		{"every 0d", recurrence{}, false},
+		{"after 0h", recurrence{}, false},
+		{"every 00mo", recurrence{}, false},
+		{"after tomorrow", recurrence{}, false},
+		{"sometimes", recurrence{}, false},
+		{"0 9 * *", recurrence{}, false},
+		{"0 0 30 2 *", recurrence{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseRecurrence(test.rule)
+		if (err == nil) != test.valid {
+			t.Errorf("parseRecurrence(%q): error %v", test.rule, err)
+			continue
+		}
+		if got.span != test.want.span || got.after != test.want.after {
+			t.Errorf("parseRecurrence(%q) = %+v, want %+v", test.rule, got, test.want)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q): want an error", expr)
+		}
+	}
+}
+
+func at(year int, month time.Month, day int, hour int, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.Local)
+}
+
+func TestCronNext(t *testing.T) {
+	// 2026-10-16 is a Friday.
+	friday := at(2026, time.October, 16, 14, 30)
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"0 9 * * 1-5", friday, at(2026, time.October, 19, 9, 0)},
+		{"0 9 * * 1-5", at(2026, time.October, 16, 8, 0), at(2026, time.October, 16, 9, 0)},
+		// Strictly after the given time.
+		{"30 14 * * *", friday, at(2026, time.October, 17, 14, 30)},
+		{"*/15 * * * *", at(2026, time.October, 16, 14, 31), at(2026, time.October, 16, 14, 45)},
+		{"0,30 9-10 * * *", friday, at(2026, time.October, 17, 9, 0)},
+		{"0 0 * * 7", friday, at(2026, time.October, 18, 0, 0)},
+		{"0 0 * * 0", friday, at(2026, time.October, 18, 0, 0)},
+
+		// With only one of day of month and day of week restricted, that
+		// one has to match.
+		{"0 0 13 * *", friday, at(2026, time.November, 13, 0, 0)},
+		{"0 0 * * 2", friday, at(2026, time.October, 20, 0, 0)},
+		// With both restricted, either matches: the 13th or a Friday.
+		{"0 0 13 * 5", at(2026, time.October, 10, 12, 0), at(2026, time.October, 13, 0, 0)},
+		{"0 0 13 * 5", at(2026, time.October, 13, 12, 0), at(2026, time.October, 16, 0, 0)},
+		{"0 0 1 * 1", friday, at(2026, time.October, 19, 0, 0)},
+
+		// Months without the day are skipped.
+		{"0 0 31 * *", at(2026, time.October, 31, 12, 0), at(2026, time.December, 31, 0, 0)},
+		{"0 0 29 2 *", at(2026, time.March, 1, 0, 0), at(2028, time.February, 29, 0, 0)},
+		{"0 12 1 */3 *", friday, at(2027, time.January, 1, 12, 0)},
+		{"0 0 1 1 *", at(2026, time.December, 31, 23, 59), at(2027, time.January, 1, 0, 0)},
+	}
+	for _, test := range tests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", test.expr, err)
+			continue
+		}
+		got, ok := c.next(test.from)
+		if !ok || !got.Equal(test.want) {
+			t.Errorf("%q after %s = %s, want %s", test.expr, test.from.Format(time.RFC3339), got.Format(time.RFC3339), test.want.Format(time.RFC3339))
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	c, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := c.next(at(2026, time.October, 16, 0, 0)); ok {
+		t.Errorf("'0 0 30 2 *' matched %s", got)
+	}
+}
+
+func TestNextDue(t *testing.T) {
+	friday := at(2026, time.October, 16, 14, 30)
+	tests := []struct {
+		rule string
+		due  string
+		done time.Time
+		want string
+	}{
+		{"weekly", "2026-10-16", friday, "2026-10-23"},
+		{"daily", "2026-10-16", friday, "2026-10-17"},
+		// Fixed schedules skip instances that are overdue already.
+		{"weekly", "2026-10-02", friday, "2026-10-16"},
+		{"daily", "2026-10-01", friday, "2026-10-16"},
+		{"monthly", "2026-01-31", at(2026, time.January, 30, 9, 0), "2026-02-28"},
+		{"yearly", "2024-02-29", at(2024, time.February, 29, 9, 0), "2025-02-28"},
+		// Without a due date, the schedule starts on the day it was done.
+		{"every 2w", "", friday, "2026-10-30"},
+		{"after 3d", "2026-10-01", friday, "2026-10-19"},
+		{"after 3d", "2026-12-01", friday, "2026-10-19"},
+		{"every 12h", "2026-10-16T09:00:00Z", time.Date(2026, time.October, 16, 14, 30, 0, 0, time.UTC), "2026-10-16T21:00:00Z"},
+		{"daily", "2026-10-16T09:00:00Z", time.Date(2026, time.October, 16, 14, 30, 0, 0, time.UTC), "2026-10-17T09:00:00Z"},
+		// Cron schedules start after the due date or when the task was
+		// done, whichever is later.
+		{"0 9 * * 1", "2026-10-01", friday, at(2026, time.October, 19, 9, 0).Format(time.RFC3339)},
+		{"0 9 * * 1", "2026-10-26", friday, at(2026, time.November, 2, 9, 0).Format(time.RFC3339)},
+	}
+	for _, test := range tests {
+		r, err := parseRecurrence(test.rule)
+		if err != nil {
+			t.Errorf("parseRecurrence(%q): %v", test.rule, err)
+			continue
+		}
+		got, err := r.nextDue(Task{Due: test.due}, test.done)
+		if err != nil {
+			t.Errorf("%q due %q: %v", test.rule, test.due, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q due %q done %s = %s, want %s", test.rule, test.due, test.done.Format(time.RFC3339), got, test.want)
+		}
+	}
+}
+
+// A rule that does not move the due date, as in files written before zero
+// spans were refused, fails instead of looping.
+func TestNextDueStuck(t *testing.T) {
+	r := recurrence{span: "0d"}
+	if got, err := r.nextDue(Task{Due: "2026-10-01"}, at(2026, time.October, 16, 14, 30)); err == nil {
+		t.Errorf("nextDue with a zero span = %s, want an error", got)
+	}
+}
+
+func TestNextInstanceName(t *testing.T) {
+	tests := []struct {
+		name  string
+		tasks []string
+		want  string
+	}{
+		{"backup", nil, "backup-2"},
+		{"backup-2", nil, "backup-3"},
+		{"backup-2", []string{"backup-3", "backup-4"}, "backup-5"},
+		{"release-v1", nil, "release-v1-2"},
+	}
+	for _, test := range tests {
+		tasks := map[string]Task{test.name: {}}
+		for _, name := range test.tasks {
+			tasks[name] = Task{}
+		}
+		if got := nextInstanceName(tasks, test.name); got != test.want {
+			t.Errorf("nextInstanceName(%q) = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// FieldSchema declares a custom field in the schema section of the task
+// file. Without a schema any field can hold any string; with one, only
+// the declared fields can be set and their values are checked.
+type FieldSchema struct {
+	Type     string   `json:"type" yaml:"type"`
+	Values   []string `json:"values,omitempty" yaml:"values,omitempty"`
+	Default  string   `json:"default,omitempty" yaml:"default,omitempty"`
+	Required bool     `json:"required,omitempty" yaml:"required,omitempty"`
+}
+
+var fieldTypes = []string{"string", "int", "float", "date", "enum", "user"}
+
+// fieldSchema is the schema of the task file, for typed filters and
+// sorting.
+var fieldSchema map[string]FieldSchema
+
+// check validates the declaration itself.
+func (fs FieldSchema) check() error {
+	if !contains(fieldTypes, fs.Type) {
+		return fmt.Errorf("unknown field type '%s'; use one of %s", fs.Type, strings.Join(fieldTypes, ", "))
+	}
+	if fs.Type == "enum" && len(fs.Values) == 0 {
+		return fmt.Errorf("an enum field needs values")
+	}
+	if fs.Type != "enum" && len(fs.Values) > 0 {
+		return fmt.Errorf("only enum fields have values")
+	}
+	if fs.Default != "" {
+		if _, err := fs.normalize(fs.Default); err != nil {
+			return fmt.Errorf("default: %v", err)
+		}
+	}
+	return nil
+}
+
+// normalize checks a value against the type of the field and returns it
+// the way it is stored.
+func (fs FieldSchema) normalize(value string) (string, error) {
+	switch fs.Type {
+	case "int":
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return "", fmt.Errorf("'%s' is not a whole number", value)
+		}
+		return strconv.Itoa(n), nil
+	case "float":
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return "", fmt.Errorf("'%s' is not a number", value)
+		}
+		return formatAmount(f), nil
+	case "date":
+		return parseWhen(value, time.Now())
+	case "enum":
+		for _, v := range fs.Values {
+			if strings.EqualFold(v, value) {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("'%s' is not one of %s", value, strings.Join(fs.Values, ", "))
+	case "user":
+		if user := parseUser(value); user != "" {
+			return user, nil
+		}
+		return "", fmt.Errorf("no user given")
+	}
+	return value, nil
+}
+
+// compare orders two stored values of the field.
+func (fs FieldSchema) compare(a string, b string) int {
+	switch fs.Type {
+	case "int", "float":
+		fa, erra := strconv.ParseFloat(a, 64)
+		fb, errb := strconv.ParseFloat(b, 64)
+		if erra == nil && errb == nil {
+			return compareFloats(fa, fb)
+		}
+	case "date":
+		ta, oka := dueEnd(a)
+		tb, okb := dueEnd(b)
+		if oka && okb {
+			return compareFloats(float64(ta.Unix()), float64(tb.Unix()))
+		}
+	case "enum":
+		ia, ib := indexOf(fs.Values, a), indexOf(fs.Values, b)
+		if ia >= 0 && ib >= 0 {
+			return ia - ib
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func compareFloats(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func indexOf(list []string, value string) int {
+	for i, v := range list {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkField checks a value for a field against the schema and returns
+// it the way it is stored.
+func checkField(schema map[string]FieldSchema, field string, value string) (string, error) {
+	if len(schema) == 0 {
+		return value, nil
+	}
+	fs, ok := schema[field]
+	if !ok {
+		msg := "unknown field '" + field + "'"
+		if similar := similarField(schema, field); similar != "" {
+			msg += "; did you mean '" + similar + "'?"
+		}
+		return "", fmt.Errorf("%s", msg)
+	}
+	value, err := fs.normalize(value)
+	if err != nil {
+		return "", fmt.Errorf("field '%s': %v", field, err)
+	}
+	return value, nil
+}
+
+// similarField returns the declared field closest to a misspelt one, if
+// any is close enough.
+func similarField(schema map[string]FieldSchema, field string) string {
+	best, bestDistance := "", 3
+	for name := range schema {
+		if strings.HasPrefix(name, field) || strings.HasPrefix(field, name) {
+			return name
+		}
+		if d := editDistance(name, field); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// applySchema fills in defaults and checks that the required fields are
+// set.
+func applySchema(schema map[string]FieldSchema, task *Task) error {
+	names := []string{}
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	missing := []string{}
+	for _, name := range names {
+		fs := schema[name]
+		if _, ok := task.Fields[name]; ok {
+			continue
+		}
+		if fs.Default != "" {
+			value, _ := fs.normalize(fs.Default)
+			if task.Fields == nil {
+				task.Fields = map[string]string{}
+			}
+			task.Fields[name] = value
+		} else if fs.Required {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required fields not set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func loadSchema(s Storage) map[string]FieldSchema {
+	conf, err := loadHeader(s)
+	if err != nil {
+		panic(err)
+	}
+	return conf.Schema
+}
+
+// A fieldFilter is a --filter comparing a custom field to a value.
+type fieldFilter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// Longer operators first, so ">=" is not read as ">".
+var filterOps = []string{"!=", ">=", "<=", "=", "<", ">"}
+
+func parseFieldFilter(filter string) (fieldFilter, bool) {
+	for i := range filter {
+		for _, op := range filterOps {
+			if i > 0 && strings.HasPrefix(filter[i:], op) {
+				return fieldFilter{Field: filter[:i], Op: op, Value: filter[i+len(op):]}, true
+			}
+		}
+	}
+	return fieldFilter{}, false
+}
+
+// matches compares the field of a task to the filter value, as the type
+// in the schema says. "=" and "!=" also match "(unset)". The assignees
+// and watchers of a task match if any of them does; "!=" if none does.
+func (f fieldFilter) matches(task Task) bool {
+	if people, ok := task.people(f.Field); ok {
+		if f.Op == "!=" {
+			return !fieldFilter{Field: f.Field, Op: "=", Value: f.Value}.matches(task)
+		}
+		if f.Value = parseUser(f.Value); f.Value == "" {
+			f.Value = "(unset)"
+		}
+		if len(people) == 0 {
+			return f.matchesValue("(unset)")
+		}
+		for _, user := range people {
+			if f.matchesValue(user) {
+				return true
+			}
+		}
+		return false
+	}
+	return f.matchesValue(task.GetField(f.Field))
+}
+
+func (f fieldFilter) matchesValue(value string) bool {
+	expected := f.Value
+	fs, typed := fieldSchema[f.Field]
+	if typed && expected != "(unset)" {
+		if v, err := fs.normalize(expected); err == nil {
+			expected = v
+		}
+	}
+	switch f.Op {
+	case "=":
+		return value == expected
+	case "!=":
+		return value != expected
+	}
+	if value == "(unset)" {
+		return false
+	}
+	c := strings.Compare(value, expected)
+	if typed {
+		c = fs.compare(value, expected)
+	}
+	switch f.Op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// sortValue returns a property of a task to sort by: one of the built-in
+// ones, or a custom field.
+func sortValue(name string, task Task, key string) string {
+	switch key {
+	case "name":
+		return name
+	case "title":
+		return task.Title
+	case "state":
+		return task.State
+	case "assignee":
+		return joinPeople(task.Assignees)
+	case "due":
+		if due, ok := taskDue(task); ok {
+			return due.UTC().Format(time.RFC3339)
+		}
+		return ""
+	case "created":
+		return task.CreatedAt
+	case "updated":
+		return task.UpdatedAt
+	}
+	return task.Fields[key]
+}
+
+// sortTaskNames orders tasks by the --sort keys, then by name. A key
+// starting with "-" sorts descending; unset values always go last.
+func sortTaskNames(tasks map[string]Task, keys []string) []string {
+	names := []string{}
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sort.SliceStable(names, func(i, j int) bool {
+		for _, key := range keys {
+			desc := strings.HasPrefix(key, "-")
+			key = strings.TrimPrefix(key, "-")
+			a := sortValue(names[i], tasks[names[i]], key)
+			b := sortValue(names[j], tasks[names[j]], key)
+			if a == "" || b == "" {
+				if a != b {
+					return b == ""
+				}
+				continue
+			}
+			c := strings.Compare(a, b)
+			if fs, ok := fieldSchema[key]; ok {
+				c = fs.compare(a, b)
+			}
+			if c != 0 {
+				return c < 0 != desc
+			}
+		}
+		return false
+	})
+	return names
+}
+
+func defineSchemaField(s Storage, field string, fs FieldSchema) {
+	if err := fs.check(); err != nil {
+		print(err.Error() + "\n")
+		exitStatus = 1
+		return
+	}
+	err := s.Transaction(func(tx Storage) error {
+		conf, err := tx.Load()
+		if err != nil {
+			return err
+		}
+		// Existing values have to fit the new declaration.
+		for name, task := range conf.Tasks {
+			if value, ok := task.Fields[field]; ok {
+				if _, err := fs.normalize(value); err != nil {
+					return fmt.Errorf("task '%s': field '%s': %v", name, field, err)
+				}
+			}
+		}
+		if conf.Schema == nil {
+			conf.Schema = map[string]FieldSchema{}
+		}
+		conf.Schema[field] = fs
+		return tx.Save(&conf)
+	})
+	if err != nil {
+		print(err.Error() + "\n")
+		exitStatus = 1
+		return
+	}
+	print("Defined field '" + field + "'\n")
+}
+
+func undefineSchemaField(s Storage, field string) {
+	err := s.Transaction(func(tx Storage) error {
+		conf, err := tx.Load()
+		if err != nil {
+			return err
+		}
+		if _, ok := conf.Schema[field]; !ok {
+			return fmt.Errorf("no field '%s' in the schema", field)
+		}
+		delete(conf.Schema, field)
+		if len(conf.Schema) == 0 {
+			conf.Schema = nil
+		}
+		return tx.Save(&conf)
+	})
+	if err != nil {
+		print(err.Error() + "\n")
+		exitStatus = 1
+		return
+	}
+	print("Removed field '" + field + "' from the schema\n")
+}
+
+func showSchema(schema map[string]FieldSchema) {
+	switch *exportFormat {
+	case "table":
+		names := []string{}
+		for name := range schema {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetColWidth(100)
+		table.SetHeader([]string{"Field", "Type", "Values", "Default", "Required"})
+		for _, name := range names {
+			fs := schema[name]
+			required := ""
+			if fs.Required {
+				required = "yes"
+			}
+			table.Append([]string{name, fs.Type, strings.Join(fs.Values, ", "), fs.Default, required})
+		}
+		table.Render()
+	case "json":
+		res, _ := json.Marshal(schema)
+		fmt.Println(string(res))
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testSchema = map[string]FieldSchema{
+	"points":   {Type: "int"},
+	"cost":     {Type: "float"},
+	"deadline": {Type: "date"},
+	"size":     {Type: "enum", Values: []string{"S", "M", "L"}},
+	"owner":    {Type: "user", Required: true},
+	"team":     {Type: "string", Default: "core"},
+	"priority": {Type: "enum", Values: []string{"low", "high"}, Default: "low", Required: true},
+}
+
+func TestCheckField(t *testing.T) {
+	tests := []struct {
+		field string
+		value string
+		want  string
+		valid bool
+	}{
+		{"points", " 3 ", "3", true},
+		{"points", "3.5", "", false},
+		{"points", "many", "", false},
+		{"cost", "2.50", "2.5", true},
+		{"cost", "cheap", "", false},
+		{"deadline", "2026-11-01", "2026-11-01", true},
+		{"deadline", "someday", "", false},
+		{"size", "m", "M", true},
+		{"size", "XL", "", false},
+		{"owner", "ann", "ann", true},
+		{"owner", "none", "", false},
+		{"team", "anything", "anything", true},
+		{"pionts", "3", "", false},
+		{"unknown", "x", "", false},
+	}
+	for _, test := range tests {
+		got, err := checkField(testSchema, test.field, test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("checkField(%s, %q): error %v", test.field, test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("checkField(%s, %q) = %q, want %q", test.field, test.value, got, test.want)
+		}
+	}
+
+	// Without a schema, any field can hold anything.
+	if got, err := checkField(nil, "anything", "goes"); err != nil || got != "goes" {
+		t.Errorf("checkField without a schema = %q, %v", got, err)
+	}
+}
+
+func TestApplySchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		want   map[string]string
+		valid  bool
+	}{
+		{"required field missing", nil, nil, false},
+		{"required field set", map[string]string{"owner": "ann"}, map[string]string{"owner": "ann", "team": "core", "priority": "low"}, true},
+		{"defaults do not overwrite", map[string]string{"owner": "ann", "team": "web", "priority": "high"}, map[string]string{"owner": "ann", "team": "web", "priority": "high"}, true},
+	}
+	for _, test := range tests {
+		task := Task{Fields: test.fields}
+		err := applySchema(testSchema, &task)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(task.Fields, test.want) {
+			t.Errorf("%s: fields %v, want %v", test.name, task.Fields, test.want)
+		}
+	}
+}
+
+func TestFieldSchemaCheck(t *testing.T) {
+	tests := []struct {
+		fs    FieldSchema
+		valid bool
+	}{
+		{FieldSchema{Type: "int", Default: "1", Required: true}, true},
+		{FieldSchema{Type: "enum", Values: []string{"a", "b"}, Default: "B"}, true},
+		{FieldSchema{Type: "number"}, false},
+		{FieldSchema{Type: "enum"}, false},
+		{FieldSchema{Type: "string", Values: []string{"a"}}, false},
+		{FieldSchema{Type: "int", Default: "one"}, false},
+		{FieldSchema{Type: "enum", Values: []string{"a", "b"}, Default: "c"}, false},
+	}
+	for _, test := range tests {
+		if err := test.fs.check(); (err == nil) != test.valid {
+			t.Errorf("%+v: error %v", test.fs, err)
+		}
+	}
+}
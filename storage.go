@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Storage is a place where tasks are kept. Commands only talk to a
+// Storage, so the on-disk format is decided once, in openStorage.
+type Storage interface {
+	// Load returns all tasks.
+	Load() (TaskConfig, error)
+	// Save replaces all tasks with the given ones.
+	Save(conf *TaskConfig) error
+	// GetTask returns a single task and whether it exists.
+	GetTask(name string) (Task, bool, error)
+	// PutTask creates or replaces a single task.
+	PutTask(name string, task Task) error
+	// DeleteTask removes a single task.
+	DeleteTask(name string) error
+	// Transaction runs fn against a view of the storage; changes made
+	// through tx are persisted together, and only if fn returns nil.
+	Transaction(fn func(tx Storage) error) error
+	Close() error
+}
+
+// openStorage returns the Storage for file. An empty or "auto" backend
+// is derived from the file extension, or is "dir" for a directory. A
+// readOnly storage cannot be changed, but can be shared with other
+// readers where the backend locks files itself.
+func openStorage(file string, backend string, readOnly bool) (Storage, error) {
+	var s Storage
+	var err error
+
+	if backend == "" || backend == "auto" {
+		backend = backendForFile(file)
+	}
+	switch backend {
+	case "yaml":
+		s = &fileStorage{file: file, codec: yamlCodec{}}
+	case "json":
+		s = &fileStorage{file: file, codec: jsonCodec{}}
+	case "bolt":
+		if s, err = openBoltStorage(file, readOnly); err != nil {
+			return nil, err
+		}
+	case "dir":
+		s = &dirStorage{dir: file}
+	default:
+		return nil, errors.New("unknown backend '" + backend + "'")
+	}
+
+	// Refuse files written by a newer version of task before anything
+	// can be overwritten in a format we do not understand.
+	if fv, ok := s.(formatVersioned); ok {
+		version, err := fv.StoredVersion()
+		if err == nil {
+			err = checkFormatVersion(version)
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// headerStorage is implemented by storages that keep the schema and the
+// workflow apart from the tasks, so they can be read without decoding
+// every task.
+type headerStorage interface {
+	// Header returns the TaskConfig without its tasks.
+	Header() (TaskConfig, error)
+}
+
+// loadHeader returns the format version, schema and workflow of s.
+func loadHeader(s Storage) (TaskConfig, error) {
+	if h, ok := s.(headerStorage); ok {
+		return h.Header()
+	}
+	conf, err := s.Load()
+	conf.Tasks = nil
+	return conf, err
+}
+
+func backendForFile(file string) string {
+	if isDirLayout(file) {
+		return "dir"
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return "json"
+	case ".db", ".bolt":
+		return "bolt"
+	}
+	return "yaml"
+}
+
+// memStorage keeps tasks in memory; the file based backends use it to
+// run transactions before writing the result in one go.
+type memStorage struct {
+	conf *TaskConfig
+}
+
+func (m *memStorage) Load() (TaskConfig, error) {
+	return *m.conf, nil
+}
+
+func (m *memStorage) Save(conf *TaskConfig) error {
+	*m.conf = *conf
+	return nil
+}
+
+func (m *memStorage) GetTask(name string) (Task, bool, error) {
+	task, ok := m.conf.Tasks[name]
+	return copyTask(task), ok, nil
+}
+
+// copyTask returns a deep copy, so changing the fields or comments of
+// the copy does not change the original.
+func copyTask(task Task) Task {
+	var c Task
+	dat, _ := json.Marshal(task)
+	json.Unmarshal(dat, &c)
+	return c
+}
+
+func (m *memStorage) PutTask(name string, task Task) error {
+	if m.conf.Tasks == nil {
+		m.conf.Tasks = map[string]Task{}
+	}
+	m.conf.Tasks[name] = task
+	return nil
+}
+
+func (m *memStorage) DeleteTask(name string) error {
+	delete(m.conf.Tasks, name)
+	return nil
+}
+
+func (m *memStorage) Transaction(fn func(tx Storage) error) error {
+	return fn(m)
+}
+
+func (m *memStorage) Close() error {
+	return nil
+}
+
+type codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type yamlCodec struct{}
+
+func (yamlCodec) Marshal(v interface{}) ([]byte, error)      { return yaml.Marshal(v) }
+func (yamlCodec) Unmarshal(data []byte, v interface{}) error { return yaml.Unmarshal(data, v) }
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.MarshalIndent(v, "", "  ") }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// fileStorage keeps all tasks in a single file, which is rewritten as a
+// whole on every change.
+type fileStorage struct {
+	file  string
+	codec codec
+}
+
+func (f *fileStorage) Load() (TaskConfig, error) {
+	return readTasks(f.file, f.codec)
+}
+
+func (f *fileStorage) Save(conf *TaskConfig) error {
+	return writeTasks(f.file, f.codec, conf)
+}
+
+func (f *fileStorage) GetTask(name string) (Task, bool, error) {
+	conf, err := f.Load()
+	if err != nil {
+		return Task{}, false, err
+	}
+	task, ok := conf.Tasks[name]
+	return task, ok, nil
+}
+
+// GetTasks reads the file once for all tasks.
+func (f *fileStorage) GetTasks(names []string) (map[string]Task, error) {
+	conf, err := f.Load()
+	if err != nil {
+		return nil, err
+	}
+	tasks := map[string]Task{}
+	for _, name := range names {
+		if task, ok := conf.Tasks[name]; ok {
+			tasks[name] = task
+		}
+	}
+	return tasks, nil
+}
+
+func (f *fileStorage) PutTask(name string, task Task) error {
+	return f.Transaction(func(tx Storage) error {
+		return tx.PutTask(name, task)
+	})
+}
+
+func (f *fileStorage) DeleteTask(name string) error {
+	return f.Transaction(func(tx Storage) error {
+		return tx.DeleteTask(name)
+	})
+}
+
+func (f *fileStorage) Transaction(fn func(tx Storage) error) error {
+	conf, err := f.Load()
+	if err != nil {
+		return err
+	}
+	if err = fn(&memStorage{conf: &conf}); err != nil {
+		return err
+	}
+	return f.Save(&conf)
+}
+
+func (f *fileStorage) Close() error {
+	return nil
+}
+
+func (f *fileStorage) StoredVersion() (int, error) {
+	dat, err := ioutil.ReadFile(f.file)
+	if os.IsNotExist(err) {
+		return currentFormatVersion, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var raw interface{}
+	if err = f.codec.Unmarshal(dat, &raw); err != nil {
+		return 0, err
+	}
+	doc, _ := normalize(raw).(map[string]interface{})
+	return formatVersion(doc), nil
+}
+
+func writeTasks(file string, c codec, conf *TaskConfig) error {
+	var err error
+	var d []byte
+	conf.Version = currentFormatVersion
+	d, err = c.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(file, d, 0644, *backups)
+	return err
+}
+
+func readTasks(file string, c codec) (TaskConfig, error) {
+	var conf TaskConfig
+	var err error
+	var dat []byte
+
+	if dat, err = ioutil.ReadFile(file); err != nil {
+		return conf, err
+	}
+	return decodeConfig(c, dat)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	tasksBucket = []byte("tasks")
+	metaBucket  = []byte("meta")
+	versionKey  = []byte("version")
+	schemaKey   = []byte("schema")
+	workflowKey = []byte("workflow")
+)
+
+// boltStorage keeps every task as a separate JSON record in a bolt
+// database, so changing one task does not rewrite all the others.
+type boltStorage struct {
+	db *bolt.DB
+	// tx is set for the storage handed to a Transaction callback.
+	tx *bolt.Tx
+}
+
+// openBoltStorage opens the database; read-only, it takes a shared file
+// lock, so readers do not wait for each other.
+func openBoltStorage(file string, readOnly bool) (*boltStorage, error) {
+	// A new database is created by the first command that changes tasks;
+	// reading does not leave an empty one behind.
+	if _, err := os.Stat(file); os.IsNotExist(err) && readOnly {
+		return nil, err
+	}
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		// Databases from before the meta bucket are set up once, with
+		// write access.
+		ready := false
+		db.View(func(tx *bolt.Tx) error {
+			ready = tx.Bucket(tasksBucket) != nil && tx.Bucket(metaBucket) != nil
+			return nil
+		})
+		if ready {
+			return &boltStorage{db: db}, nil
+		}
+		db.Close()
+		return openBoltStorage(file, false)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		isNew := tx.Bucket(tasksBucket) == nil
+		if _, err := tx.CreateBucketIfNotExists(tasksBucket); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if isNew {
+			return putBoltVersion(meta)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStorage{db: db}, nil
+}
+
+func (b *boltStorage) view(fn func(tx *bolt.Tx) error) error {
+	if b.tx != nil {
+		return fn(b.tx)
+	}
+	return b.db.View(fn)
+}
+
+func (b *boltStorage) update(fn func(tx *bolt.Tx) error) error {
+	if b.tx != nil {
+		return fn(b.tx)
+	}
+	return b.db.Update(fn)
+}
+
+func (b *boltStorage) StoredVersion() (int, error) {
+	var version int
+	err := b.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(metaBucket).Get(versionKey)
+		if v == nil {
+			return nil
+		}
+		var err error
+		version, err = strconv.Atoi(string(v))
+		return err
+	})
+	return version, err
+}
+
+func putBoltVersion(meta *bolt.Bucket) error {
+	return meta.Put(versionKey, []byte(strconv.Itoa(currentFormatVersion)))
+}
+
+// readBoltMeta reads the schema and workflow from the meta bucket.
+func readBoltMeta(meta *bolt.Bucket, conf *TaskConfig) error {
+	if v := meta.Get(schemaKey); v != nil {
+		if err := json.Unmarshal(v, &conf.Schema); err != nil {
+			return err
+		}
+	}
+	if v := meta.Get(workflowKey); v != nil {
+		if err := json.Unmarshal(v, &conf.Workflow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltStorage) Header() (TaskConfig, error) {
+	conf := TaskConfig{Version: currentFormatVersion}
+	err := b.view(func(tx *bolt.Tx) error {
+		return readBoltMeta(tx.Bucket(metaBucket), &conf)
+	})
+	return conf, err
+}
+
+func (b *boltStorage) Load() (TaskConfig, error) {
+	conf := TaskConfig{Version: currentFormatVersion, Tasks: map[string]Task{}}
+	version, err := b.StoredVersion()
+	if err != nil {
+		return conf, err
+	}
+	err = b.view(func(tx *bolt.Tx) error {
+		if err := readBoltMeta(tx.Bucket(metaBucket), &conf); err != nil {
+			return err
+		}
+		return tx.Bucket(tasksBucket).ForEach(func(k, v []byte) error {
+			task, err := decodeTaskData(jsonCodec{}, v, version)
+			if err != nil {
+				return err
+			}
+			conf.Tasks[string(k)] = task
+			return nil
+		})
+	})
+	return conf, err
+}
+
+func (b *boltStorage) Save(conf *TaskConfig) error {
+	return b.update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(tasksBucket); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(tasksBucket)
+		if err != nil {
+			return err
+		}
+		for name, task := range conf.Tasks {
+			if err := putBoltTask(bucket, name, task); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		if err := putBoltMeta(meta, schemaKey, conf.Schema, len(conf.Schema) == 0); err != nil {
+			return err
+		}
+		if err := putBoltMeta(meta, workflowKey, conf.Workflow, conf.Workflow == nil); err != nil {
+			return err
+		}
+		return putBoltVersion(meta)
+	})
+}
+
+func (b *boltStorage) GetTask(name string) (Task, bool, error) {
+	var task Task
+	var ok bool
+	version, err := b.StoredVersion()
+	if err != nil {
+		return task, false, err
+	}
+	err = b.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(tasksBucket).Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		var err error
+		task, err = decodeTaskData(jsonCodec{}, v, version)
+		return err
+	})
+	return task, ok, err
+}
+
+// SubtaskStates only decodes the parent and state of every task.
+func (b *boltStorage) SubtaskStates(parent string) ([]string, error) {
+	states := []string{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(tasksBucket).ForEach(func(k, v []byte) error {
+			var ref subtaskRef
+			if err := json.Unmarshal(v, &ref); err != nil {
+				return err
+			}
+			if ref.Parent == parent {
+				states = append(states, ref.State)
+			}
+			return nil
+		})
+	})
+	return states, err
+}
+
+func (b *boltStorage) PutTask(name string, task Task) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return putBoltTask(tx.Bucket(tasksBucket), name, task)
+	})
+}
+
+func (b *boltStorage) DeleteTask(name string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tasksBucket).Delete([]byte(name))
+	})
+}
+
+func (b *boltStorage) Transaction(fn func(tx Storage) error) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return fn(&boltStorage{db: b.db, tx: tx})
+	})
+}
+
+func (b *boltStorage) Close() error {
+	if b.tx != nil {
+		return nil
+	}
+	return b.db.Close()
+}
+
+// putBoltMeta stores v as JSON under key, or removes the key if empty.
+func putBoltMeta(meta *bolt.Bucket, key []byte, v interface{}, empty bool) error {
+	if empty {
+		return meta.Delete(key)
+	}
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return meta.Put(key, dat)
+}
+
+func putBoltTask(bucket *bolt.Bucket, name string, task Task) error {
+	v, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(name), v)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	dirTaskExt = ".yaml"
+	// dirHeader holds everything of the TaskConfig except the tasks;
+	// being a dot file, it can never clash with a task, as taskFile
+	// escapes a leading dot.
+	dirHeader = ".task.yaml"
+)
+
+// dirStorage keeps every task in its own YAML file inside a directory,
+// so changes to different tasks do not conflict in version control.
+type dirStorage struct {
+	dir string
+	// header is the format version, schema and workflow from the
+	// header file, once read.
+	header *TaskConfig
+}
+
+func (d *dirStorage) readHeader() (*TaskConfig, error) {
+	if d.header != nil {
+		return d.header, nil
+	}
+	header := &TaskConfig{}
+	dat, err := ioutil.ReadFile(filepath.Join(d.dir, dirHeader))
+	if os.IsNotExist(err) {
+		// A directory that does not exist yet will be created in the
+		// current format.
+		if _, serr := os.Stat(d.dir); os.IsNotExist(serr) {
+			header.Version = currentFormatVersion
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err = yaml.Unmarshal(dat, header); err != nil {
+		return nil, err
+	}
+	d.header = header
+	return header, nil
+}
+
+func (d *dirStorage) StoredVersion() (int, error) {
+	header, err := d.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	return header.Version, nil
+}
+
+// writeHeader stores everything of conf but the tasks in the header file.
+func (d *dirStorage) writeHeader(conf *TaskConfig) error {
+	header := &TaskConfig{Version: currentFormatVersion, Schema: conf.Schema, Workflow: conf.Workflow}
+	dat, err := yaml.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(filepath.Join(d.dir, dirHeader), dat, 0644, 0); err != nil {
+		return err
+	}
+	d.header = header
+	return nil
+}
+
+func isDirLayout(file string) bool {
+	if strings.HasSuffix(file, string(os.PathSeparator)) {
+		return true
+	}
+	info, err := os.Stat(file)
+	return err == nil && info.IsDir()
+}
+
+// taskFile returns the file for a task; names are escaped so a task
+// called "a/b" does not end up in a subdirectory, and a task called
+// ".task" does not overwrite the header.
+func (d *dirStorage) taskFile(name string) string {
+	escaped := url.PathEscape(name)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return filepath.Join(d.dir, escaped+dirTaskExt)
+}
+
+// legacyTaskFile is where a task starting with a dot was kept before
+// taskFile escaped the dot, or "" for names that never had one. Such
+// files are still read, and moved on the next change of the task.
+func (d *dirStorage) legacyTaskFile(name string) string {
+	escaped := url.PathEscape(name)
+	if !strings.HasPrefix(escaped, ".") || escaped+dirTaskExt == dirHeader {
+		return ""
+	}
+	return filepath.Join(d.dir, escaped+dirTaskExt)
+}
+
+func (d *dirStorage) readTaskFile(name string) ([]byte, error) {
+	dat, err := ioutil.ReadFile(d.taskFile(name))
+	if legacy := d.legacyTaskFile(name); os.IsNotExist(err) && legacy != "" {
+		dat, err = ioutil.ReadFile(legacy)
+	}
+	return dat, err
+}
+
+func (d *dirStorage) taskNames() ([]string, error) {
+	entries, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		base := entry.Name()
+		if entry.IsDir() || base == dirHeader || !strings.HasSuffix(base, dirTaskExt) {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(base, dirTaskExt))
+		if err != nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (d *dirStorage) Header() (TaskConfig, error) {
+	conf := TaskConfig{Version: currentFormatVersion}
+	header, err := d.readHeader()
+	if err != nil {
+		return conf, err
+	}
+	conf.Schema = header.Schema
+	conf.Workflow = header.Workflow
+	return conf, nil
+}
+
+func (d *dirStorage) Load() (TaskConfig, error) {
+	conf := TaskConfig{Version: currentFormatVersion, Tasks: map[string]Task{}}
+	header, err := d.readHeader()
+	if err != nil {
+		return conf, err
+	}
+	conf.Schema = header.Schema
+	conf.Workflow = header.Workflow
+	names, err := d.taskNames()
+	if err != nil {
+		return conf, err
+	}
+	for _, name := range names {
+		task, _, err := d.GetTask(name)
+		if err != nil {
+			return conf, err
+		}
+		conf.Tasks[name] = task
+	}
+	return conf, nil
+}
+
+func (d *dirStorage) Save(conf *TaskConfig) error {
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+	names, err := d.taskNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := conf.Tasks[name]; !ok {
+			if err := d.DeleteTask(name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, task := range conf.Tasks {
+		if err := d.PutTask(name, task); err != nil {
+			return err
+		}
+	}
+	return d.writeHeader(conf)
+}
+
+func (d *dirStorage) GetTask(name string) (Task, bool, error) {
+	var task Task
+	dat, err := d.readTaskFile(name)
+	if os.IsNotExist(err) {
+		return task, false, nil
+	}
+	if err != nil {
+		return task, false, err
+	}
+	version, err := d.StoredVersion()
+	if err != nil {
+		return task, false, err
+	}
+	if task, err = decodeTaskData(yamlCodec{}, dat, version); err != nil {
+		return task, false, err
+	}
+	return task, true, nil
+}
+
+// SubtaskStates only decodes the parent and state of every task.
+func (d *dirStorage) SubtaskStates(parent string) ([]string, error) {
+	names, err := d.taskNames()
+	if err != nil {
+		return nil, err
+	}
+	states := []string{}
+	for _, name := range names {
+		dat, err := d.readTaskFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var ref subtaskRef
+		if err = yaml.Unmarshal(dat, &ref); err != nil {
+			return nil, err
+		}
+		if ref.Parent == parent {
+			states = append(states, ref.State)
+		}
+	}
+	return states, nil
+}
+
+func (d *dirStorage) PutTask(name string, task Task) error {
+	dat, err := yaml.Marshal(&task)
+	if err != nil {
+		return err
+	}
+	// Backups would only clutter the directory; version control
+	// already keeps the history of every file.
+	if err = writeFileAtomic(d.taskFile(name), dat, 0644, 0); err != nil {
+		return err
+	}
+	return d.removeLegacyTaskFile(name)
+}
+
+func (d *dirStorage) DeleteTask(name string) error {
+	err := os.Remove(d.taskFile(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return d.removeLegacyTaskFile(name)
+}
+
+func (d *dirStorage) removeLegacyTaskFile(name string) error {
+	legacy := d.legacyTaskFile(name)
+	if legacy == "" {
+		return nil
+	}
+	if err := os.Remove(legacy); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Transaction collects the changes made through tx and writes only the
+// touched task files once fn succeeds.
+func (d *dirStorage) Transaction(fn func(tx Storage) error) error {
+	tx := &dirTx{dir: d, pending: map[string]*Task{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.header != nil {
+		if err := d.writeHeader(tx.header); err != nil {
+			return err
+		}
+	}
+	for name, task := range tx.pending {
+		var err error
+		if task == nil {
+			err = d.DeleteTask(name)
+		} else {
+			err = d.PutTask(name, *task)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dirStorage) Close() error {
+	return nil
+}
+
+type dirTx struct {
+	dir *dirStorage
+	// pending holds the tasks changed in this transaction; nil means
+	// deleted.
+	pending map[string]*Task
+	// header is set when the transaction saved a whole TaskConfig.
+	header *TaskConfig
+}
+
+func (t *dirTx) Load() (TaskConfig, error) {
+	conf, err := t.dir.Load()
+	if err != nil {
+		return conf, err
+	}
+	for name, task := range t.pending {
+		if task == nil {
+			delete(conf.Tasks, name)
+		} else {
+			conf.Tasks[name] = *task
+		}
+	}
+	if t.header != nil {
+		conf.Schema = t.header.Schema
+		conf.Workflow = t.header.Workflow
+	}
+	return conf, nil
+}
+
+func (t *dirTx) Header() (TaskConfig, error) {
+	if t.header != nil {
+		return TaskConfig{Version: currentFormatVersion, Schema: t.header.Schema, Workflow: t.header.Workflow}, nil
+	}
+	return t.dir.Header()
+}
+
+func (t *dirTx) Save(conf *TaskConfig) error {
+	names, err := t.dir.taskNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		t.pending[name] = nil
+	}
+	for name, task := range conf.Tasks {
+		task := task
+		t.pending[name] = &task
+	}
+	t.header = &TaskConfig{Schema: conf.Schema, Workflow: conf.Workflow}
+	return nil
+}
+
+func (t *dirTx) GetTask(name string) (Task, bool, error) {
+	if task, ok := t.pending[name]; ok {
+		if task == nil {
+			return Task{}, false, nil
+		}
+		return *task, true, nil
+	}
+	return t.dir.GetTask(name)
+}
+
+func (t *dirTx) PutTask(name string, task Task) error {
+	t.pending[name] = &task
+	return nil
+}
+
+func (t *dirTx) DeleteTask(name string) error {
+	t.pending[name] = nil
+	return nil
+}
+
+func (t *dirTx) Transaction(fn func(tx Storage) error) error {
+	return fn(t)
+}
+
+func (t *dirTx) Close() error {
+	return nil
+}
+
+// convertTasks copies all tasks from s into a new storage at target,
+// e.g. from a single file to a directory or the other way around.
+func convertTasks(s Storage, target string, backend string) {
+	if _, err := os.Stat(target); err == nil && !isEmptyDir(target) {
+		print("Target '" + target + "' already exists!\n")
+		return
+	}
+	conf, err := s.Load()
+	if err != nil {
+		panic(err)
+	}
+	t, err := openStorage(target, backend, false)
+	if err != nil {
+		panic(err)
+	}
+	defer t.Close()
+	if err = t.Save(&conf); err != nil {
+		panic(err)
+	}
+	print("Converted " + strconv.Itoa(len(conf.Tasks)) + " tasks to '" + target + "'\n")
+}
+
+func isEmptyDir(dir string) bool {
+	entries, err := ioutil.ReadDir(dir)
+	return err == nil && len(entries) == 0
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// oddNames are task names that need care wherever names become keys or
+// file names.
+var oddNames = []string{"a", "a/b", "../up", ".task", ".x", "..", "with space", "ünï", "%2E", "100%", "a.yaml", "-"}
+
+func TestStorageRoundTrip(t *testing.T) {
+	tests := []struct {
+		backend string
+		file    string
+	}{
+		{"bolt", "tasks.db"},
+		{"dir", "tasks"},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "storage")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, test.file)
+
+		want := TaskConfig{
+			Version:  currentFormatVersion,
+			Schema:   map[string]FieldSchema{"prio": {Type: "int", Default: "1"}},
+			Workflow: &Workflow{States: []string{"todo", "done"}, Closed: []string{"done"}},
+			Tasks:    map[string]Task{},
+		}
+		s, err := openStorage(file, test.backend, false)
+		if err != nil {
+			t.Fatalf("%s: %v", test.backend, err)
+		}
+		if err = s.Save(&want); err != nil {
+			t.Fatalf("%s: %v", test.backend, err)
+		}
+		for i, name := range oddNames {
+			task := Task{Title: "Task " + name, Revision: i + 1, Fields: map[string]string{"prio": "2"}}
+			if err = s.PutTask(name, task); err != nil {
+				t.Fatalf("%s: PutTask(%q): %v", test.backend, name, err)
+			}
+			want.Tasks[name] = task
+		}
+		if err = s.DeleteTask("a"); err != nil {
+			t.Fatalf("%s: %v", test.backend, err)
+		}
+		delete(want.Tasks, "a")
+		s.Close()
+
+		s, err = openStorage(file, test.backend, true)
+		if err != nil {
+			t.Fatalf("%s: %v", test.backend, err)
+		}
+		defer s.Close()
+		got, err := s.Load()
+		if err != nil {
+			t.Fatalf("%s: %v", test.backend, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Load() = %+v, want %+v", test.backend, got, want)
+		}
+		for name, task := range want.Tasks {
+			got, ok, err := s.GetTask(name)
+			if err != nil || !ok || !reflect.DeepEqual(got, task) {
+				t.Errorf("%s: GetTask(%q) = %+v, %v, %v, want %+v", test.backend, name, got, ok, err, task)
+			}
+		}
+		if _, ok, err := s.GetTask("a"); ok || err != nil {
+			t.Errorf("%s: deleted task found, error %v", test.backend, err)
+		}
+	}
+}
+
+// Reading a database that is not there fails without creating it.
+func TestBoltReadOnlyMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tasks.db")
+	if s, err := openStorage(file, "bolt", true); err == nil {
+		s.Close()
+		t.Errorf("opened a missing database")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("the database was created")
+	}
+}
+
+// Tasks starting with a dot were once kept without escaping the dot; they
+// are still found, and move to the escaped name on the next change.
+func TestDirLegacyDotFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		dirHeader:    "version: 5\n",
+		".old.yaml":  "title: Old\n",
+		".gone.yaml": "title: Gone\n",
+		"new.yaml":   "title: New\n",
+	}
+	for file, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &dirStorage{dir: dir}
+	conf, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, title := range map[string]string{".old": "Old", ".gone": "Gone", "new": "New"} {
+		if conf.Tasks[name].Title != title {
+			t.Errorf("task %q: title %q, want %q", name, conf.Tasks[name].Title, title)
+		}
+	}
+	if len(conf.Tasks) != 3 {
+		t.Errorf("tasks %v, want 3", conf.Tasks)
+	}
+
+	if err := s.PutTask(".old", Task{Title: "Changed"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteTask(".gone"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file   string
+		exists bool
+	}{
+		{"%2Eold.yaml", true},
+		{".old.yaml", false},
+		{".gone.yaml", false},
+		{dirHeader, true},
+	}
+	for _, test := range tests {
+		if _, err := os.Stat(filepath.Join(dir, test.file)); (err == nil) != test.exists {
+			t.Errorf("%s: exists %v, want %v", test.file, err == nil, test.exists)
+		}
+	}
+	if task, ok, err := s.GetTask(".old"); !ok || err != nil || task.Title != "Changed" {
+		t.Errorf("GetTask(.old) = %+v, %v, %v", task, ok, err)
+	}
+}
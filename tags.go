@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Set from --filter +tag and --filter -tag.
+var (
+	requiredTags []string
+	excludedTags []string
+)
+
+func (t *Task) HasTag(tag string) bool {
+	return contains(t.Tags, tag)
+}
+
+// parseTagFilter handles a --filter of the form +tag or -tag. It reports
+// whether the filter was one.
+func parseTagFilter(filter string) bool {
+	if strings.Contains(filter, "=") || len(filter) < 2 {
+		return false
+	}
+	switch filter[0] {
+	case '+':
+		requiredTags = append(requiredTags, filter[1:])
+	case '-':
+		excludedTags = append(excludedTags, filter[1:])
+	default:
+		return false
+	}
+	return true
+}
+
+func matchesTagFilters(task Task) bool {
+	for _, tag := range requiredTags {
+		if !task.HasTag(tag) {
+			return false
+		}
+	}
+	for _, tag := range excludedTags {
+		if task.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkTag(tag string) error {
+	if tag == "" || strings.ContainsAny(tag, " \t\n,=") || strings.HasPrefix(tag, "-") {
+		return fmt.Errorf("invalid tag '%s'; tags cannot be empty, start with '-' or contain spaces, commas or '='", tag)
+	}
+	return nil
+}
+
+func tagTask(s Storage, name string, tags []string) {
+	for i, tag := range tags {
+		tags[i] = strings.TrimPrefix(tag, "+")
+		if err := checkTag(tags[i]); err != nil {
+			print(err.Error() + "\n")
+			return
+		}
+	}
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		added := false
+		for _, tag := range tags {
+			if !task.HasTag(tag) {
+				task.Tags = append(task.Tags, tag)
+				added = true
+			}
+		}
+		if !added {
+			print("Task '" + name + "' already has these tags\n")
+			return errUnchanged
+		}
+		sort.Strings(task.Tags)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+func untagTask(s Storage, name string, tags []string) {
+	for i, tag := range tags {
+		tags[i] = strings.TrimPrefix(tag, "+")
+	}
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		kept := []string{}
+		for _, tag := range task.Tags {
+			if !contains(tags, tag) {
+				kept = append(kept, tag)
+			}
+		}
+		if len(kept) == len(task.Tags) {
+			print("Task '" + name + "' has none of these tags\n")
+			return errUnchanged
+		}
+		if len(kept) == 0 {
+			kept = nil
+		}
+		task.Tags = kept
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Tasks int    `json:"tasks"`
+	Open  int    `json:"open"`
+}
+
+// allTags returns every tag in use, sorted.
+func allTags(tasks map[string]Task) []string {
+	result := []string{}
+	for _, task := range tasks {
+		for _, tag := range task.Tags {
+			if !contains(result, tag) {
+				result = append(result, tag)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func countTags(tasks map[string]Task) []TagCount {
+	counts := []TagCount{}
+	for _, tag := range allTags(tasks) {
+		c := TagCount{Tag: tag}
+		for _, task := range tasks {
+			if task.HasTag(tag) {
+				c.Tasks++
+				if !task.IsDone() {
+					c.Open++
+				}
+			}
+		}
+		counts = append(counts, c)
+	}
+	return counts
+}
+
+func showTags(conf *TaskConfig) {
+	tasks := map[string]Task{}
+	for name, task := range conf.Tasks {
+		if matchesFilters(task) {
+			tasks[name] = task
+		}
+	}
+	counts := countTags(tasks)
+	switch *exportFormat {
+	case "table":
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetColWidth(100)
+		table.SetHeader([]string{"Tag", "Tasks", "Open"})
+		for _, c := range counts {
+			table.Append([]string{c.Tag, strconv.Itoa(c.Tasks), strconv.Itoa(c.Open)})
+		}
+		table.Render()
+	case "json":
+		res, _ := json.Marshal(counts)
+		fmt.Println(string(res))
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// stateMarkers are shown in front of the tasks in a tree.
+var stateMarkers = map[string]string{
+	"":            "[ ]",
+	"todo":        "[ ]",
+	"in-progress": "[~]",
+	"done":        "[x]",
+}
+
+const otherStateMarker = "[?]"
+
+func stateMarker(state string) string {
+	if marker, ok := stateMarkers[state]; ok {
+		return marker
+	}
+	if activeWorkflow.IsClosed(state) {
+		return stateMarkers["done"]
+	}
+	return otherStateMarker
+}
+
+// children returns the names of the direct subtasks of parent, sorted.
+func children(tasks map[string]Task, parent string) []string {
+	result := []string{}
+	for name, task := range tasks {
+		if task.Parent == parent {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// descendants returns the names of all subtasks of parent, children before
+// their own subtasks. A task is listed once, even when parents loop.
+func descendants(tasks map[string]Task, parent string) []string {
+	return descendantsOf(tasks, parent, map[string]bool{parent: true})
+}
+
+func descendantsOf(tasks map[string]Task, parent string, seen map[string]bool) []string {
+	result := []string{}
+	for _, name := range children(tasks, parent) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+		result = append(result, descendantsOf(tasks, name, seen)...)
+	}
+	return result
+}
+
+// progress counts the direct subtasks of parent and how many of them are
+// done.
+func progress(tasks map[string]Task, parent string) (done int, total int) {
+	for _, name := range children(tasks, parent) {
+		total++
+		if task := tasks[name]; task.IsDone() {
+			done++
+		}
+	}
+	return done, total
+}
+
+// subtaskScanner is implemented by storages that can find the subtasks
+// of a task without decoding every task in full.
+type subtaskScanner interface {
+	// SubtaskStates returns the states of the direct subtasks of parent.
+	SubtaskStates(parent string) ([]string, error)
+}
+
+// subtaskRef is the part of a task needed to find subtasks.
+type subtaskRef struct {
+	Parent string `json:"parent" yaml:"parent"`
+	State  string `json:"state" yaml:"state"`
+}
+
+func subtaskStates(s Storage, parent string) ([]string, error) {
+	if scanner, ok := s.(subtaskScanner); ok {
+		return scanner.SubtaskStates(parent)
+	}
+	conf, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	states := []string{}
+	for _, name := range children(conf.Tasks, parent) {
+		states = append(states, conf.Tasks[name].State)
+	}
+	return states, nil
+}
+
+// subtaskProgress counts the direct subtasks of parent in s and how many
+// of them are done.
+func subtaskProgress(s Storage, parent string) (done int, total int, err error) {
+	states, err := subtaskStates(s, parent)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, state := range states {
+		total++
+		if activeWorkflow.IsClosed(state) {
+			done++
+		}
+	}
+	return done, total, nil
+}
+
+// parentPath returns the chain of parents from name up to the top, or the
+// chain up to the point where it loops back.
+func parentPath(lookup taskLookup, name string) []string {
+	path := []string{}
+	seen := map[string]bool{}
+	for name != "" && !seen[name] {
+		seen[name] = true
+		task, ok := lookup(name)
+		if !ok || task.Parent == "" {
+			break
+		}
+		path = append(path, task.Parent)
+		name = task.Parent
+	}
+	return path
+}
+
+// checkParent tells whether name can become a subtask of parent.
+func checkParent(lookup taskLookup, name string, parent string) bool {
+	if parent == "" {
+		return true
+	}
+	if _, ok := lookup(parent); !ok {
+		print("No task '" + parent + "' found\n")
+		return false
+	}
+	if parent == name {
+		print("Task '" + name + "' cannot be its own parent\n")
+		return false
+	}
+	// name becomes an ancestor of itself if parent is already below it.
+	if path := parentPath(lookup, parent); contains(path, name) {
+		print("Task '" + name + "' cannot be a subtask of '" + parent + "': it is a parent of it\n")
+		return false
+	}
+	return true
+}
+
+func setTaskParent(s Storage, name string, parent string) {
+	if parent == "none" {
+		parent = ""
+	}
+	refused := false
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		if !checkParent(storageLookup(tx), name, parent) {
+			refused = true
+			return errUnchanged
+		}
+		task.Parent = parent
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if refused {
+		exitStatus = 1
+		return
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+// TreeNode is a task with its subtasks, for JSON output of the tree.
+type TreeNode struct {
+	Name     string     `json:"name"`
+	Title    string     `json:"title"`
+	State    string     `json:"state,omitempty"`
+	Done     int        `json:"done"`
+	Total    int        `json:"total"`
+	Subtasks []TreeNode `json:"subtasks,omitempty"`
+}
+
+// treeNode builds the tree below name; a subtask that is already in the
+// tree, because parents loop, is not followed again.
+func treeNode(conf *TaskConfig, name string, seen map[string]bool) TreeNode {
+	seen[name] = true
+	task := conf.Tasks[name]
+	node := TreeNode{Name: name, Title: task.Title, State: task.State}
+	node.Done, node.Total = progress(conf.Tasks, name)
+	for _, child := range children(conf.Tasks, name) {
+		if !seen[child] {
+			node.Subtasks = append(node.Subtasks, treeNode(conf, child, seen))
+		}
+	}
+	return node
+}
+
+// treeRoots returns the tasks to start the tree at: the given task, or all
+// tasks without a (known) parent.
+func treeRoots(conf *TaskConfig, name string) []string {
+	if name != "" {
+		if _, ok := conf.Tasks[name]; !ok {
+			return nil
+		}
+		return []string{name}
+	}
+	roots := []string{}
+	for name, task := range conf.Tasks {
+		if _, ok := conf.Tasks[task.Parent]; !ok {
+			roots = append(roots, name)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// cycleRoot groups the tasks that no root leads to, because their parents
+// form a loop.
+const cycleRoot = "(cycle)"
+
+// cycleNodes builds a tree for each loop of parents that is not in seen
+// yet, starting at the first task of the loop by name, along with the
+// tasks below it.
+func cycleNodes(conf *TaskConfig, seen map[string]bool) []TreeNode {
+	names := []string{}
+	for name := range conf.Tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var nodes []TreeNode
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		// Every parent up from here is a task that is not in the tree
+		// either, so this ends on the loop.
+		visited := map[string]bool{}
+		for !visited[name] {
+			visited[name] = true
+			name = conf.Tasks[name].Parent
+		}
+		start := name
+		for other := conf.Tasks[name].Parent; other != name; other = conf.Tasks[other].Parent {
+			if other < start {
+				start = other
+			}
+		}
+		nodes = append(nodes, treeNode(conf, start, seen))
+	}
+	return nodes
+}
+
+func showTree(conf *TaskConfig, name string) {
+	roots := treeRoots(conf, name)
+	if roots == nil {
+		print("No task '" + name + "' found\n")
+		return
+	}
+	nodes := []TreeNode{}
+	seen := map[string]bool{}
+	for _, root := range roots {
+		nodes = append(nodes, treeNode(conf, root, seen))
+	}
+	if name == "" {
+		if loops := cycleNodes(conf, seen); loops != nil {
+			nodes = append(nodes, TreeNode{Name: cycleRoot, Subtasks: loops})
+		}
+	}
+
+	switch *exportFormat {
+	case "table":
+		var b strings.Builder
+		for _, node := range nodes {
+			writeTree(&b, node, 0)
+		}
+		fmt.Print(b.String())
+	case "json":
+		res, _ := json.Marshal(nodes)
+		fmt.Println(string(res))
+	}
+}
+
+func writeTree(b *strings.Builder, node TreeNode, depth int) {
+	if node.Name == cycleRoot {
+		b.WriteString(strings.Repeat("  ", depth) + node.Name + "\n")
+		for _, child := range node.Subtasks {
+			writeTree(b, child, depth+1)
+		}
+		return
+	}
+	b.WriteString(strings.Repeat("  ", depth) + stateMarker(node.State) + " " + node.Name + ": " + node.Title)
+	if node.Total > 0 {
+		b.WriteString(" (" + strconv.Itoa(node.Done) + "/" + strconv.Itoa(node.Total) + ")")
+	}
+	b.WriteString("\n")
+	for _, child := range node.Subtasks {
+		writeTree(b, child, depth+1)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// A mutation is the group of events one command wrote to the journal.
+type mutation []Event
+
+// undoStacks walks the journal and returns the mutations of user that can
+// still be undone and redone, most recent last.
+func undoStacks(events []Event, user string) (done []mutation, undone []mutation) {
+	bySeq := map[int]mutation{}
+	var order []int
+	for _, e := range events {
+		tx := e.Tx
+		if tx == 0 {
+			tx = e.Seq
+		}
+		if _, ok := bySeq[tx]; !ok {
+			order = append(order, tx)
+		}
+		bySeq[tx] = append(bySeq[tx], e)
+	}
+
+	for _, tx := range order {
+		m := bySeq[tx]
+		first := m[0]
+		if first.Actor != user || first.Action == "import" {
+			continue
+		}
+		switch {
+		case first.Undoes != 0:
+			if len(done) > 0 {
+				undone = append(undone, done[len(done)-1])
+				done = done[:len(done)-1]
+			}
+		case first.Redoes != 0:
+			if len(undone) > 0 {
+				done = append(done, undone[len(undone)-1])
+				undone = undone[:len(undone)-1]
+			}
+		default:
+			done = append(done, m)
+			undone = nil
+		}
+	}
+	return done, undone
+}
+
+func undoMutations(js *journalStorage, n int) {
+	events, err := js.journal.Events()
+	if err != nil {
+		panic(err)
+	}
+	done, _ := undoStacks(events, parseUser("me"))
+	if len(done) == 0 {
+		print("Nothing to undo\n")
+		return
+	}
+	if n > len(done) {
+		n = len(done)
+	}
+
+	for i := 0; i < n; i++ {
+		m := done[len(done)-1-i]
+		if err := revert(js, events, m, true); err != nil {
+			print(err.Error() + "\n")
+			return
+		}
+	}
+}
+
+func redoMutation(js *journalStorage) {
+	events, err := js.journal.Events()
+	if err != nil {
+		panic(err)
+	}
+	_, undone := undoStacks(events, parseUser("me"))
+	if len(undone) == 0 {
+		print("Nothing to redo\n")
+		return
+	}
+	if err := revert(js, events, undone[len(undone)-1], false); err != nil {
+		print(err.Error() + "\n")
+	}
+}
+
+// revert undoes a mutation, or redoes it when undo is false. It refuses
+// when a task has been changed since, so nobody's later work is lost.
+func revert(js *journalStorage, events []Event, m mutation, undo bool) error {
+	tx := m[0].Tx
+	if tx == 0 {
+		tx = m[0].Seq
+	}
+
+	if undo {
+		js.undoes = tx
+	} else {
+		js.redoes = tx
+	}
+	err := js.Transaction(func(s Storage) error {
+		for _, e := range m {
+			expect, restore := e.After, e.Before
+			if !undo {
+				expect, restore = e.Before, e.After
+			}
+
+			current, ok, err := s.GetTask(e.Task)
+			if err != nil {
+				return err
+			}
+			if ok != (expect != nil) || ok && !sameContent(current, *expect) {
+				return errors.New("Refusing to revert '" + e.Action + "': task '" + e.Task + "' was changed" + changedBy(events, e) + " since")
+			}
+
+			if restore == nil {
+				err = s.DeleteTask(e.Task)
+			} else {
+				// Revisions only go up, or --if-revision could match
+				// an older version of the task again.
+				t := *restore
+				t.Revision = current.Revision + 1
+				err = s.PutTask(e.Task, t)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	js.undoes, js.redoes = 0, 0
+	if err != nil {
+		return err
+	}
+
+	verb := "Undid"
+	if !undo {
+		verb = "Redid"
+	}
+	for _, e := range m {
+		print(verb + " '" + e.Action + "' on task '" + e.Task + "' (" + humanAt(e.At) + ")\n")
+		for _, c := range e.Changes {
+			print("  " + describeChange(c, undo) + "\n")
+		}
+	}
+	return nil
+}
+
+// sameContent compares tasks regardless of their revision.
+func sameContent(a Task, b Task) bool {
+	a.Revision, b.Revision = 0, 0
+	return sameTask(a, b)
+}
+
+// changedBy names whoever last touched the task after event e.
+func changedBy(events []Event, e Event) string {
+	for i := len(events) - 1; i >= 0; i-- {
+		later := events[i]
+		if later.Seq <= e.Seq {
+			break
+		}
+		if later.Task == e.Task {
+			return " by " + later.Actor + " (" + later.Action + ", " + humanAt(later.At) + ")"
+		}
+	}
+	return ""
+}
+
+func describeChange(c Change, reverse bool) string {
+	old, cur := c.Old, c.New
+	if reverse {
+		old, cur = cur, old
+	}
+	return c.Field + ": " + quoteValue(old) + " -> " + quoteValue(cur)
+}
+
+func quoteValue(v string) string {
+	if v == "" {
+		return "(unset)"
+	}
+	return strconv.Quote(v)
+}
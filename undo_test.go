@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// step is a change made by user through the journal.
+type step struct {
+	user   string
+	change func(s Storage) error
+}
+
+func TestUndoAfterOtherChanges(t *testing.T) {
+	defer os.Setenv("USER", os.Getenv("USER"))
+	defer os.Setenv("SUDO_USER", os.Getenv("SUDO_USER"))
+	os.Unsetenv("SUDO_USER")
+
+	put := func(user string, name string, title string) step {
+		return step{user, func(s Storage) error { return s.PutTask(name, Task{Title: title}) }}
+	}
+	remove := func(user string, name string) step {
+		return step{user, func(s Storage) error { return s.DeleteTask(name) }}
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// refused names who changed the task since, when the undo of
+		// ann's last change is refused.
+		refused string
+		title   string
+	}{
+		{"own change", []step{put("ann", "a", "A"), put("ann", "a", "B")}, "", "A"},
+		{"another task changed", []step{put("ann", "a", "A"), put("ann", "a", "B"), put("bob", "b", "X")}, "", "A"},
+		{"changed by someone else", []step{put("ann", "a", "A"), put("ann", "a", "B"), put("bob", "a", "C")}, "bob", "C"},
+		{"deleted by someone else", []step{put("ann", "a", "A"), put("ann", "a", "B"), remove("bob", "a")}, "bob", ""},
+		{"created again by someone else", []step{put("ann", "a", "A"), remove("ann", "a"), put("bob", "a", "C")}, "bob", "C"},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "undo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "tasks.yaml")
+		if err := ioutil.WriteFile(file, []byte("version: 5\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fs := &fileStorage{file: file, codec: yamlCodec{}}
+		js := newJournalStorage(fs, file, "test")
+		for _, step := range test.steps {
+			os.Setenv("USER", step.user)
+			if err := step.change(js); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+
+		events, err := js.journal.Events()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		os.Setenv("USER", "ann")
+		done, _ := undoStacks(events, "ann")
+		if len(done) == 0 {
+			t.Fatalf("%s: nothing to undo", test.name)
+		}
+		err = revert(js, events, done[len(done)-1], true)
+		switch {
+		case test.refused == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.refused != "" && err == nil:
+			t.Errorf("%s: undo was not refused", test.name)
+		case test.refused != "" && !strings.Contains(err.Error(), " by "+test.refused+" "):
+			t.Errorf("%s: %q does not name %s", test.name, err, test.refused)
+		}
+
+		task, _, err := fs.GetTask("a")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if task.Title != test.title {
+			t.Errorf("%s: title %q, want %q", test.name, task.Title, test.title)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Workflow defines the states a task can be in. Closed states count as
+// done: closed tasks are hidden unless --show-done is given and no longer
+// block other tasks. Without Transitions any state can follow any other;
+// otherwise a state can only move to the states listed for it. A task
+// without a state is in the first state.
+type Workflow struct {
+	States      []string            `json:"states" yaml:"states"`
+	Closed      []string            `json:"closed,omitempty" yaml:"closed,omitempty"`
+	Transitions map[string][]string `json:"transitions,omitempty" yaml:"transitions,omitempty"`
+	// Requires lists what a task needs to move into a state: a
+	// "comment" given with set-state, an "assignee", a "due" date or a
+	// custom field as "field:<name>".
+	Requires map[string][]string `json:"requires,omitempty" yaml:"requires,omitempty"`
+}
+
+// defaultWorkflow is used when the task file does not define one.
+var defaultWorkflow = Workflow{
+	States: []string{"todo", "in-progress", "done"},
+	Closed: []string{"done"},
+}
+
+// activeWorkflow is the workflow of the task file.
+var activeWorkflow = defaultWorkflow
+
+func workflowOf(conf *TaskConfig) Workflow {
+	if conf.Workflow == nil {
+		return defaultWorkflow
+	}
+	return *conf.Workflow
+}
+
+func loadWorkflow(s Storage) Workflow {
+	conf, err := loadHeader(s)
+	if err != nil {
+		panic(err)
+	}
+	return workflowOf(&conf)
+}
+
+func (w Workflow) IsClosed(state string) bool {
+	return contains(w.Closed, state)
+}
+
+func (w Workflow) initialState() string {
+	if len(w.States) == 0 {
+		return ""
+	}
+	return w.States[0]
+}
+
+// workingState is where claimed tasks go: the first state after the
+// initial one that is not closed, if there is one.
+func (w Workflow) workingState() string {
+	for i, state := range w.States {
+		if i > 0 && !w.IsClosed(state) {
+			return state
+		}
+	}
+	return ""
+}
+
+func (w Workflow) check() error {
+	if len(w.States) == 0 {
+		return fmt.Errorf("a workflow needs states")
+	}
+	for i, state := range w.States {
+		if state == "" || contains(w.States[:i], state) {
+			return fmt.Errorf("state '%s' is empty or listed twice", state)
+		}
+	}
+	for _, state := range w.Closed {
+		if !contains(w.States, state) {
+			return fmt.Errorf("closed state '%s' is not a state", state)
+		}
+	}
+	for from, to := range w.Transitions {
+		for _, state := range append([]string{from}, to...) {
+			if !contains(w.States, state) {
+				return fmt.Errorf("transition %s -> %s: '%s' is not a state", from, strings.Join(to, ", "), state)
+			}
+		}
+	}
+	for state, requirements := range w.Requires {
+		if !contains(w.States, state) {
+			return fmt.Errorf("requirements for '%s': not a state", state)
+		}
+		for _, r := range requirements {
+			if r != "comment" && r != "assignee" && r != "due" && !strings.HasPrefix(r, "field:") {
+				return fmt.Errorf("unknown requirement '%s'; use comment, assignee, due or field:<name>", r)
+			}
+		}
+	}
+	return nil
+}
+
+// checkTransition tells why task cannot move to state, if it cannot.
+func (w Workflow) checkTransition(task Task, state string, comment string) error {
+	if !contains(w.States, state) {
+		return fmt.Errorf("unknown state '%s'; use one of %s", state, strings.Join(w.States, ", "))
+	}
+	from := task.State
+	if from == "" {
+		from = w.initialState()
+	}
+	if allowed, ok := w.Transitions[from]; ok && from != state && !contains(allowed, state) {
+		if len(allowed) == 0 {
+			return fmt.Errorf("a task in state '%s' cannot change state", from)
+		}
+		return fmt.Errorf("a task in state '%s' can only move to %s", from, strings.Join(allowed, ", "))
+	}
+	for _, r := range w.Requires[state] {
+		switch {
+		case r == "comment" && comment == "":
+			return fmt.Errorf("moving to '%s' requires a comment; give one with --comment", state)
+		case r == "assignee" && len(task.Assignees) == 0:
+			return fmt.Errorf("moving to '%s' requires an assignee", state)
+		case r == "due" && task.Due == "":
+			return fmt.Errorf("moving to '%s' requires a due date", state)
+		case strings.HasPrefix(r, "field:"):
+			field := strings.TrimPrefix(r, "field:")
+			if _, ok := task.Fields[field]; !ok {
+				return fmt.Errorf("moving to '%s' requires the field '%s'", state, field)
+			}
+		}
+	}
+	return nil
+}
+
+// stateOrder sorts states as listed in the workflow, others after them.
+func (w Workflow) stateOrder(states []string) {
+	sort.SliceStable(states, func(i, j int) bool {
+		a, b := indexOf(w.States, states[i]), indexOf(w.States, states[j])
+		if a < 0 || b < 0 {
+			if a != b {
+				return b < 0
+			}
+			return states[i] < states[j]
+		}
+		return a < b
+	})
+}
+
+// parseWorkflowFlags builds a workflow from set-workflow flags:
+// transitions as "from:to,to" and requirements as "state:requirement,...".
+func parseWorkflowFlags(states []string, closed []string, transitions []string, requires []string) (Workflow, error) {
+	w := Workflow{States: states, Closed: closed}
+	for _, t := range transitions {
+		split := strings.SplitN(t, ":", 2)
+		if len(split) != 2 {
+			return w, fmt.Errorf("transitions are given as from:to,to; not '%s'", t)
+		}
+		if w.Transitions == nil {
+			w.Transitions = map[string][]string{}
+		}
+		w.Transitions[split[0]] = append(w.Transitions[split[0]], splitList(split[1])...)
+	}
+	for _, r := range requires {
+		split := strings.SplitN(r, ":", 2)
+		if len(split) != 2 {
+			return w, fmt.Errorf("requirements are given as state:requirement,requirement; not '%s'", r)
+		}
+		if w.Requires == nil {
+			w.Requires = map[string][]string{}
+		}
+		w.Requires[split[0]] = append(w.Requires[split[0]], splitList(split[1])...)
+	}
+	return w, w.check()
+}
+
+func splitList(list string) []string {
+	result := []string{}
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func setWorkflow(s Storage, w Workflow) {
+	err := s.Transaction(func(tx Storage) error {
+		conf, err := tx.Load()
+		if err != nil {
+			return err
+		}
+		// Tasks in a state that no longer exists could never move.
+		for name, task := range conf.Tasks {
+			if task.State != "" && !contains(w.States, task.State) {
+				return fmt.Errorf("task '%s' is in state '%s', which the workflow does not have", name, task.State)
+			}
+		}
+		conf.Workflow = &w
+		return tx.Save(&conf)
+	})
+	if err != nil {
+		print(err.Error() + "\n")
+		exitStatus = 1
+		return
+	}
+	showWorkflow(w)
+}
+
+func showWorkflow(w Workflow) {
+	switch *exportFormat {
+	case "table":
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetColWidth(100)
+		table.SetHeader([]string{"State", "Closed", "Can move to", "Requires"})
+		for _, state := range w.States {
+			closed := ""
+			if w.IsClosed(state) {
+				closed = "yes"
+			}
+			next := "(any)"
+			if to, ok := w.Transitions[state]; ok {
+				next = strings.Join(to, ", ")
+			}
+			table.Append([]string{state, closed, next, strings.Join(w.Requires[state], ", ")})
+		}
+		table.Render()
+	case "json":
+		res, _ := json.Marshal(w)
+		fmt.Println(string(res))
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// WorkEntry is an interval someone worked on a task. A running timer has
+// no end yet.
+type WorkEntry struct {
+	User  string `json:"user" yaml:"user"`
+	Start string `json:"start" yaml:"start"`
+	End   string `json:"end,omitempty" yaml:"end,omitempty"`
+	Note  string `json:"note,omitempty" yaml:"note,omitempty"`
+}
+
+func (w *WorkEntry) Running() bool {
+	return w.End == ""
+}
+
+// Interval returns the start and end of the entry; a running timer ends
+// now.
+func (w *WorkEntry) Interval(now time.Time) (time.Time, time.Time) {
+	start := parseTime(w.Start)
+	end := now
+	if !w.Running() {
+		end = parseTime(w.End)
+	}
+	return start, end
+}
+
+func (w *WorkEntry) Duration(now time.Time) time.Duration {
+	start, end := w.Interval(now)
+	return end.Sub(start)
+}
+
+func (w *WorkEntry) String() string {
+	end := "running"
+	if !w.Running() {
+		end = w.End
+	}
+	return w.User + " " + w.Start + " .. " + end
+}
+
+// Logged returns the total time worked on the task.
+func (t *Task) Logged(now time.Time) time.Duration {
+	var total time.Duration
+	for _, w := range t.Worklog {
+		total += w.Duration(now)
+	}
+	return total
+}
+
+// runningTimer returns the index of the running timer of user, or -1.
+func (t *Task) runningTimer(user string) int {
+	for i, w := range t.Worklog {
+		if w.User == user && w.Running() {
+			return i
+		}
+	}
+	return -1
+}
+
+// formatWorked shows a duration in hours and minutes, like 1h30m.
+func formatWorked(d time.Duration) string {
+	d = d.Round(time.Minute)
+	h, m := int(d.Hours()), int(d.Minutes())%60
+	switch {
+	case h == 0:
+		return fmt.Sprintf("%dm", m)
+	case m == 0:
+		return fmt.Sprintf("%dh", h)
+	}
+	return fmt.Sprintf("%dh%dm", h, m)
+}
+
+// stopTimers stops the running timers of user on all tasks but except
+// and returns the names of those tasks.
+func stopTimers(tx Storage, user string, except string, now time.Time) ([]string, error) {
+	conf, err := tx.Load()
+	if err != nil {
+		return nil, err
+	}
+	stopped := []string{}
+	for name, task := range conf.Tasks {
+		i := task.runningTimer(user)
+		if name == except || i < 0 {
+			continue
+		}
+		task = copyTask(task)
+		task.Worklog[i].End = now.Format(time.RFC3339)
+		task.Update()
+		if err := tx.PutTask(name, task); err != nil {
+			return nil, err
+		}
+		stopped = append(stopped, name)
+	}
+	sort.Strings(stopped)
+	return stopped, nil
+}
+
+// startTimer starts working on a task. Someone only works on one task at
+// a time, so their other timers are stopped. With claim, the task is also
+// assigned to them and, when it was not started yet, moved to the working
+// state of the workflow.
+func startTimer(s Storage, name string, claim bool) {
+	user := parseUser("me")
+	now := time.Now()
+	var stopped []string
+	var task Task
+	err := s.Transaction(func(tx Storage) error {
+		var err error
+		task, err = updateTask(tx, name, func(task *Task) error {
+			if _, ok, _ := tx.GetTask(name); !ok {
+				print("No task '" + name + "' found\n")
+				return errUnchanged
+			}
+			if task.runningTimer(user) >= 0 {
+				print("You are already working on '" + name + "'\n")
+				return errUnchanged
+			}
+			if claim {
+				task.Assignees, _ = addPeople(task.Assignees, []string{user})
+				working := activeWorkflow.workingState()
+				started := task.State != "" && task.State != activeWorkflow.initialState()
+				if working != "" && !started {
+					if err := activeWorkflow.checkTransition(*task, working, ""); err != nil {
+						print(err.Error() + "\n")
+						return errUnchanged
+					}
+					task.State = working
+				}
+			}
+			task.Worklog = append(task.Worklog, WorkEntry{User: user, Start: now.Format(time.RFC3339)})
+			return nil
+		})
+		if err != nil || task.runningTimer(user) < 0 {
+			return err
+		}
+		stopped, err = stopTimers(tx, user, name, now)
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+	for _, other := range stopped {
+		print("Stopped working on '" + other + "'\n")
+	}
+	showTask(s, name, task)
+}
+
+// stopTimer stops the running timer of the current user on a task, or on
+// whatever task it runs on.
+func stopTimer(s Storage, name string) {
+	user := parseUser("me")
+	now := time.Now()
+	if name == "" {
+		conf, err := s.Load()
+		if err != nil {
+			panic(err)
+		}
+		for other, task := range conf.Tasks {
+			if task.runningTimer(user) >= 0 {
+				name = other
+			}
+		}
+		if name == "" {
+			print("You are not working on any task\n")
+			return
+		}
+	}
+	var worked time.Duration
+	task, err := updateTask(s, name, func(task *Task) error {
+		i := task.runningTimer(user)
+		if i < 0 {
+			print("You are not working on '" + name + "'\n")
+			return errUnchanged
+		}
+		task.Worklog[i].End = now.Format(time.RFC3339)
+		worked = task.Worklog[i].Duration(now)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if worked > 0 {
+		print("Worked " + formatWorked(worked) + " on '" + name + "'\n")
+	}
+	showTask(s, name, task)
+}
+
+// logWork records time worked without a timer, ending now.
+func logWork(s Storage, name string, duration string, noteArray []string) {
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		print("Cannot understand '" + duration + "' as time worked; use e.g. 1h30m or 45m\n")
+		return
+	}
+	now := time.Now()
+	entry := WorkEntry{
+		User:  parseUser("me"),
+		Start: now.Add(-d).Format(time.RFC3339),
+		End:   now.Format(time.RFC3339),
+		Note:  strings.Join(noteArray, " "),
+	}
+	task, ok, err := updateExistingTask(s, name, func(tx Storage, task *Task) error {
+		task.Worklog = append(task.Worklog, entry)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		showTask(s, name, task)
+	}
+}
+
+type TimesheetEntry struct {
+	Date     string  `json:"date"`
+	User     string  `json:"user"`
+	Task     string  `json:"task"`
+	Title    string  `json:"title"`
+	Start    string  `json:"start"`
+	End      string  `json:"end,omitempty"`
+	Hours    float64 `json:"hours"`
+	Duration string  `json:"duration"`
+	Note     string  `json:"note,omitempty"`
+}
+
+// timesheet lists the work of user (everyone if empty) between from and
+// to, cutting off intervals that stick out.
+func timesheet(conf *TaskConfig, user string, from time.Time, to time.Time, now time.Time) []TimesheetEntry {
+	entries := []TimesheetEntry{}
+	for name, task := range conf.Tasks {
+		for _, w := range task.Worklog {
+			if user != "" && w.User != user {
+				continue
+			}
+			start, end := w.Interval(now)
+			if start.Before(from) {
+				start = from
+			}
+			if end.After(to) {
+				end = to
+			}
+			if !end.After(start) {
+				continue
+			}
+			e := TimesheetEntry{
+				Date:     formatDate(start.Local()),
+				User:     w.User,
+				Task:     name,
+				Title:    task.Title,
+				Start:    start.Format(time.RFC3339),
+				Hours:    float64(end.Sub(start).Round(time.Minute)) / float64(time.Hour),
+				Duration: formatWorked(end.Sub(start)),
+				Note:     w.Note,
+			}
+			if !w.Running() {
+				e.End = end.Format(time.RFC3339)
+			}
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Start != entries[j].Start {
+			return parseTime(entries[i].Start).Before(parseTime(entries[j].Start))
+		}
+		return entries[i].Task < entries[j].Task
+	})
+	return entries
+}
+
+// parseSheetTime reads --from and --to; a date means the start of that
+// day, or its end with end set, so the day itself is included.
+func parseSheetTime(value string, now time.Time, end bool) (time.Time, error) {
+	when, err := parseWhen(value, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t, err := time.ParseInLocation(dateFormat, when, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, when)
+}
+
+func showTimesheet(conf *TaskConfig, fromValue string, toValue string, user string) {
+	now := time.Now()
+	// The last seven days by default.
+	from := startOfDay(now).AddDate(0, 0, -6)
+	var err error
+	if fromValue != "" {
+		if from, err = parseSheetTime(fromValue, now, false); err != nil {
+			print(err.Error() + "\n")
+			return
+		}
+	}
+	to := now
+	if toValue != "" {
+		if to, err = parseSheetTime(toValue, now, true); err != nil {
+			print(err.Error() + "\n")
+			return
+		}
+	}
+	if user != "" {
+		user = parseUser(user)
+	}
+	entries := timesheet(conf, user, from, to, now)
+
+	switch *exportFormat {
+	case "table":
+		totals := map[string]time.Duration{}
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetColWidth(100)
+		table.SetHeader([]string{"Date", "User", "Task", "Title", "Time", "Note"})
+		for _, e := range entries {
+			table.Append([]string{e.Date, e.User, e.Task, e.Title, e.Duration, e.Note})
+			totals[e.User] += time.Duration(e.Hours * float64(time.Hour))
+		}
+		table.Render()
+		users := []string{}
+		for u := range totals {
+			users = append(users, u)
+		}
+		sort.Strings(users)
+		for _, u := range users {
+			fmt.Println("Total for " + u + ": " + formatWorked(totals[u]))
+		}
+	case "json":
+		res, _ := json.Marshal(entries)
+		fmt.Println(string(res))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"date", "user", "task", "title", "start", "end", "hours", "note"})
+		for _, e := range entries {
+			w.Write([]string{e.Date, e.User, e.Task, e.Title, e.Start, e.End, formatAmount(e.Hours), e.Note})
+		}
+		w.Flush()
+	}
+}